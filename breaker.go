@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// how to retry invoking PowerShell.exe
+type retryPolicy struct {
+	initial   time.Duration
+	max       time.Duration
+	jitter    float64
+	threshold int
+}
+
+type breakerState int
+
+const (
+	// PowerShell.exe is running, or being retried
+	breakerClosed breakerState = iota
+	// PowerShell.exe is down; requests fail fast
+	breakerOpen
+	// trying to recover in background; requests still fail fast
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// a circuit breaker that stops making clients wait for PowerShell.exe that
+// fails to start repeatedly
+type breaker struct {
+	policy   retryPolicy
+	state    breakerState
+	failures int
+	rand     *rand.Rand
+}
+
+func newBreaker(policy retryPolicy) *breaker {
+	return &breaker{
+		policy: policy,
+		state:  breakerClosed,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// the delay before the next retry: exponential backoff with jitter
+func (b *breaker) backoff() time.Duration {
+	d := b.policy.initial
+	for i := 1; i < b.failures && d < b.policy.max; i++ {
+		d *= 2
+	}
+	if d > b.policy.max {
+		d = b.policy.max
+	}
+	jitter := float64(d) * b.policy.jitter * (2*b.rand.Float64() - 1)
+	return d + time.Duration(jitter)
+}
+
+func (b *breaker) succeed() {
+	b.failures = 0
+	b.set(breakerClosed)
+}
+
+func (b *breaker) fail() {
+	b.failures += 1
+	if b.state == breakerHalfOpen || b.failures >= b.policy.threshold {
+		b.set(breakerOpen)
+	}
+}
+
+func (b *breaker) set(state breakerState) {
+	if b.state != state {
+		log.Printf("breaker: %s -> %s (failures: %d)", b.state, state, b.failures)
+		b.state = state
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestBreakerBackoff(t *testing.T) {
+	b := newBreaker(retryPolicy{initial: time.Second, max: 10 * time.Second, jitter: 0, threshold: 3})
+
+	expected := []time.Duration{1, 1, 2, 4, 8, 10, 10}
+	for i, d := range expected {
+		b.failures = i
+		if b.backoff() != d*time.Second {
+			t.Errorf("wrong backoff for %d failures: %v", i, b.backoff())
+		}
+	}
+
+	b.policy.jitter = 0.5
+	b.failures = 3
+	for i := 0; i < 100; i++ {
+		d := b.backoff()
+		if d < 2*time.Second || d > 6*time.Second {
+			t.Errorf("jitter is out of range: %v", d)
+		}
+	}
+}
+
+func TestBreakerState(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	b := newBreaker(retryPolicy{initial: time.Second, max: 10 * time.Second, threshold: 2})
+
+	b.fail()
+	if b.state != breakerClosed {
+		t.Errorf("should be closed: %s", b.state)
+	}
+	b.fail()
+	if b.state != breakerOpen {
+		t.Errorf("should be open: %s", b.state)
+	}
+
+	b.set(breakerHalfOpen)
+	b.fail()
+	if b.state != breakerOpen || b.failures != 3 {
+		t.Errorf("should be open again: %s", b.state)
+	}
+
+	b.set(breakerHalfOpen)
+	b.succeed()
+	if b.state != breakerClosed || b.failures != 0 {
+		t.Errorf("should be closed: %s", b.state)
+	}
+}
@@ -12,20 +12,50 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type config struct {
-	socketPath     string
-	powershellPath string
-	pipeName       string
-	format         string
-	foreground     bool
-	verbose        bool
-	stop           bool
-	logFile        string
-	version        bool
+	socketPath      string
+	controlPath     string
+	powershellPath  string
+	powershellOrder string
+	powershellPaths []string
+	repeaterScript  string
+	script          string
+	pipeName        string
+	pipeOrder       string
+	pipeNames       []string
+	pipeTimeout     time.Duration
+	standby         bool
+	standbyIdle     time.Duration
+	heartbeat       time.Duration
+	heartbeatMisses int
+	retry           retryPolicy
+	lazy            bool
+	idleTimeout     time.Duration
+	format          string
+	foreground      bool
+	verbose         bool
+	stop            bool
+	stopTimeout     time.Duration
+	kill            bool
+	logFile         string
+	configFile      string
+	version         bool
+	replace         bool
+	replacePid      int
+	sshAgentMode    bool
+	listener        net.Listener // passed by systemd
+	controlListener net.Listener // passed by systemd
+	lock            *os.File
+	flags           *flag.FlagSet
+	commandLine     map[string]string // the flags set in the command line
+	command         string
+	args            []string
 }
 
 var version = "(development version)"
@@ -39,71 +69,169 @@ func defaultSocketPath() string {
 	return filepath.Join(home, ".ssh", "wsl2-ssh-agent.sock")
 }
 
-func powershellPath() string {
-	path, err := exec.LookPath("powershell.exe")
-	if err != nil {
-		path := "/mnt/c/Windows/System32/WindowsPowerShell/v1.0/powershell.exe"
-		_, err := os.Stat(path)
-		if err == nil {
-			return path
-		} else {
-			return ""
+// candidates of each PowerShell interpreter: a command name looked up in PATH
+// first, then the standard install locations
+var powershellLocations = map[string][]string{
+	"pwsh": {
+		"pwsh.exe",
+		"/mnt/c/Program Files/PowerShell/7/pwsh.exe",
+		"/mnt/c/Program Files/PowerShell/7-preview/pwsh.exe",
+	},
+	"powershell": {
+		"powershell.exe",
+		"/mnt/c/Windows/System32/WindowsPowerShell/v1.0/powershell.exe",
+	},
+}
+
+// find the available PowerShell interpreters in the order of preference
+func powershellPaths(order string) ([]string, error) {
+	paths := []string{}
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		locations, ok := powershellLocations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown PowerShell interpreter: %q (must be pwsh or powershell)", name)
+		}
+		for _, location := range locations {
+			path, err := exec.LookPath(location)
+			if err == nil {
+				paths = append(paths, path)
+				break
+			}
 		}
 	}
-	return path
+	return paths, nil
+}
+
+func (c *config) defineFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.configFile, "config", "", "a path of the config file (default: wsl2-ssh-agent/config in $XDG_CONFIG_HOME or $XDG_CONFIG_DIRS)")
+	flags.StringVar(&c.socketPath, "socket", defaultSocketPath(), "a path of UNIX domain socket to listen")
+	flags.StringVar(&c.controlPath, "control-socket", "", "a path of UNIX domain socket to accept control commands (default: the -socket path with \".ctl\")")
+	flags.StringVar(&c.powershellPath, "powershell-path", "", "a path of PowerShell (default: search for the interpreters in -powershell-order)")
+	flags.StringVar(&c.powershellOrder, "powershell-order", "pwsh,powershell", "a comma-separated preference order of PowerShell interpreters: pwsh (PowerShell 7) and powershell (Windows PowerShell 5.1)")
+	flags.StringVar(&c.repeaterScript, "repeater-script", "", "a path of the PowerShell script to run instead of the embedded one (see the dump-script command)")
+	flags.StringVar(&c.pipeName, "pipename", "openssh-ssh-agent", "a name of pipe to connect, a preset (openssh, pageant, 1password, keeagent, or gpg4win), or auto")
+	flags.StringVar(&c.pipeOrder, "pipename-order", "openssh,pageant", "a comma-separated priority order of presets to find by -pipename auto")
+	flags.DurationVar(&c.pipeTimeout, "pipe-timeout", 3*time.Second, "give up connecting to the named pipe after this period")
+	flags.BoolVar(&c.standby, "standby", false, "keep a pre-started standby PowerShell for instant failover")
+	flags.DurationVar(&c.standbyIdle, "standby-idle", 30*time.Minute, "discard the standby PowerShell after no request for this period")
+	flags.DurationVar(&c.heartbeat, "heartbeat", 30*time.Second, "ping PowerShell after no request for this period (0 to disable)")
+	flags.IntVar(&c.heartbeatMisses, "heartbeat-misses", 2, "restart PowerShell after this number of missed pongs in a row")
+	flags.DurationVar(&c.retry.initial, "retry-initial", 1*time.Second, "the initial delay to retry invoking PowerShell")
+	flags.DurationVar(&c.retry.max, "retry-max", 5*time.Minute, "the maximum delay to retry invoking PowerShell")
+	flags.Float64Var(&c.retry.jitter, "retry-jitter", 0.2, "the ratio of random jitter added to the retry delay")
+	flags.IntVar(&c.retry.threshold, "breaker-threshold", 2, "fail requests fast after PowerShell fails to start this number of times in a row")
+	flags.BoolVar(&c.lazy, "lazy", false, "invoke PowerShell when the first client connects")
+	flags.DurationVar(&c.idleTimeout, "idle-timeout", 0, "terminate PowerShell after no request for this period (0 to disable)")
+	flags.BoolVar(&c.foreground, "foreground", false, "run in foreground mode")
+	flags.BoolVar(&c.verbose, "verbose", false, "verbose mode")
+	flags.StringVar(&c.logFile, "log", "", "a file path to write the log")
+	flags.StringVar(&c.format, "format", "auto", "an output format: auto, sh, bash, zsh, csh, tcsh, fish, nushell, elvish, xonsh, pwsh, json, or dotenv")
+	flags.BoolVar(&c.stop, "stop", false, "stop the daemon and exit")
+	flags.DurationVar(&c.stopTimeout, "stop-timeout", 5*time.Second, "kill the daemon with SIGKILL if it does not exit in this period after -stop")
+	flags.BoolVar(&c.kill, "k", false, "stop the daemon and print the commands to unset SSH_AUTH_SOCK and SSH_AGENT_PID, like ssh-agent -k")
+	flags.BoolVar(&c.replace, "replace", false, "replace the running daemon if its options are different")
+	flags.BoolVar(&c.version, "version", false, "print version and exit")
 }
 
 func newConfig() *config {
 	c := &config{}
 
-	flag.StringVar(&c.socketPath, "socket", defaultSocketPath(), "a path of UNIX domain socket to listen")
-	flag.StringVar(&c.powershellPath, "powershell-path", powershellPath(), "a path of Windows PowerShell")
-	flag.StringVar(&c.pipeName, "pipename", "openssh-ssh-agent", "a name of pipe to connect")
-	flag.BoolVar(&c.foreground, "foreground", false, "run in foreground mode")
-	flag.BoolVar(&c.verbose, "verbose", false, "verbose mode")
-	flag.StringVar(&c.logFile, "log", "", "a file path to write the log")
-	flag.StringVar(&c.format, "format", "auto", "an output format: auto, bash, zsh, csh, tcsh, or fish")
-	flag.BoolVar(&c.stop, "stop", false, "stop the daemon and exit")
-	flag.BoolVar(&c.version, "version", false, "print version and exit")
+	c.defineFlags(flag.CommandLine)
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "usage: wsl2-ssh-agent\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: wsl2-ssh-agent [options] [command]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "\ncommands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  dump-script\n    \tprint the embedded PowerShell script and exit\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  status [-json]\n    \tprint the status of the running daemon; exit with 0 (healthy), 1 (degraded), or 3 (not running)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  ctl <command> [key=value...]\n    \tsend a command to the control socket of the running daemon and print the result\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  doctor\n    \tcheck each link from ssh to ssh-agent.exe and print hints to fix problems\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  keys\n    \tlist the keys in the agent with their fingerprints\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  test-sign [fingerprint]\n    \tsign a random challenge with each key (or the key of the fingerprint) and verify the signature\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  exec [-reuse] [--] command [args...]\n    \trun the command with a private agent socket (or the running daemon's with -reuse), which is removed when the command exits\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  restart\n    \tstart the daemon, replacing the running one even if the options are the same\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "\noptions:\n")
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	flag.VisitAll(func(f *flag.Flag) {
+		if !envIgnoredFlags[f.Name] {
+			f.Usage += fmt.Sprintf(" [$%s]", envName(f.Name))
+		}
+	})
+
+	args := os.Args[1:]
+	if isSSHAgentName(os.Args[0]) {
+		var err error
+		args, err = sshAgentArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ssh-agent: %s\n%s\n", err, sshAgentUsage)
+			os.Exit(1)
+		}
+		c.sshAgentMode = true
+	}
+	flag.CommandLine.Parse(args)
+
+	// remember the command line, which wins over the config file and the
+	// environment when they are read again
+	c.commandLine = map[string]string{}
+	flag.Visit(func(f *flag.Flag) { c.commandLine[f.Name] = f.Value.String() })
+	err := applySettings(flag.CommandLine, explicitFlags(flag.CommandLine))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	c.flags = flag.CommandLine
 
-	if c.powershellPath == "" {
-		fmt.Fprintln(os.Stderr, "powershell.exe not found, use the -powershell-path to customize the path.")
+	c.command = flag.Arg(0)
+	if flag.NArg() > 0 {
+		c.args = flag.Args()[1:]
+	}
+	if c.controlPath == "" {
+		c.controlPath = c.socketPath + ".ctl"
+	}
+	switch c.command {
+	case "":
+	case "restart", "doctor", "exec":
+	case "dump-script", "status", "ctl", "keys", "test-sign":
+		return c
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", c.command)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	script, err := loadRepeaterScript(c.repeaterScript)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	c.script = script
 
-	return c
-}
+	c.pipeNames, err = pipeNameOrder(c.pipeOrder)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-func getOutputFormat(format string) string {
-	if format == "auto" {
-		shell := os.Getenv("SHELL")
-		if strings.HasSuffix(shell, "fish") {
-			format = "fish"
-		} else if strings.HasSuffix(shell, "csh") {
-			format = "csh"
-		} else {
-			format = "sh"
+	if c.powershellPath != "" {
+		c.powershellPaths = []string{c.powershellPath}
+	} else {
+		paths, err := powershellPaths(c.powershellOrder)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		c.powershellPaths = paths
 	}
-	switch format {
-	case "sh", "bash", "zsh":
-		return "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;"
-	case "csh", "tcsh":
-		return "setenv SSH_AUTH_SOCK %s"
-	case "fish":
-		return "set -x SSH_AUTH_SOCK %s"
-	default:
-		fmt.Printf("output format must be auto, bash, zsh, csh, tcsh, or fish\n")
+
+	// doctor reports it
+	if len(c.powershellPaths) == 0 && c.command != "doctor" {
+		fmt.Fprintln(os.Stderr, "neither pwsh.exe nor powershell.exe found, use the -powershell-path to customize the path.")
 		os.Exit(1)
-		return ""
 	}
+
+	return c
 }
 
 func (c *config) start() context.Context {
@@ -116,54 +244,191 @@ func (c *config) start() context.Context {
 	parent := checkDaemonMode()
 
 	// script output
-	output := fmt.Sprintf(getOutputFormat(c.format), c.socketPath)
+	format := detectOutputFormat(c.format)
+	err := checkOutputFormat(format)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	output := func(pid int) string {
+		return formatEnv(format, []envVar{{"SSH_AUTH_SOCK", c.socketPath}, {"SSH_AGENT_PID", strconv.Itoa(pid)}})
+	}
 
 	// set up the log file
 	c.setupLogFile()
 
+	// systemd socket activation: systemd owns the socket and runs this in
+	// foreground, so there is no other daemon to check
+	c.listener, c.controlListener, err = systemdListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.listener != nil {
+		path := c.listener.Addr().String()
+		if c.controlListener != nil {
+			c.controlPath = c.controlListener.Addr().String()
+		} else if c.controlPath == c.socketPath+".ctl" {
+			c.controlPath = path + ".ctl"
+		}
+		c.socketPath = path
+		log.Printf("socket activation: %s", path)
+		return signalContext()
+	}
+
+	// serialize the startup; without the lock, the socket of a daemon that
+	// is just starting could be taken as stale and removed
+	err = c.lockStartup(parent)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	// check if wsl2-ssl-agent is already running
-	serverPid := findRunningServerPid(c.socketPath)
+	peerPid := findRunningServerPid(c.socketPath)
+	serverPid := c.daemonPid(peerPid)
+
+	// systemd would start the daemon again on the next connection, and owns
+	// the socket that -replace would rename over
+	if (c.stop || c.kill || c.replace || c.command == "restart") && c.socketActivated(peerPid) {
+		if c.stop || c.kill {
+			fmt.Fprintf(os.Stderr, "%s is managed by systemd socket activation; use `systemctl --user stop wsl2-ssh-agent.socket wsl2-ssh-agent.service`\n", c.socketPath)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s is managed by systemd socket activation; change the options of the service, and use `systemctl --user restart wsl2-ssh-agent.service`\n", c.socketPath)
+		}
+		os.Exit(1)
+	}
 
-	// --stop option
-	if c.stop {
+	// --stop and -k options
+	if c.stop || c.kill {
 		if serverPid == -1 {
-			log.Fatal(fmt.Errorf("failed to find wsl2-ssh-agent"))
+			fmt.Fprintln(os.Stderr, "failed to find wsl2-ssh-agent")
+			os.Exit(1)
+		}
+
+		if !c.isDaemonProcess(serverPid) {
+			fmt.Fprintf(os.Stderr, "%s is used by another program (pid: %d), not wsl2-ssh-agent; leave it\n", c.socketPath, serverPid)
+			os.Exit(1)
 		}
 
 		log.Printf("kill wsl2-ssh-agent (pid: %d)", serverPid)
-		stopService(serverPid)
+		err = stopService(c, serverPid)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if c.kill {
+			fmt.Println(formatUnset(format, []string{"SSH_AUTH_SOCK", "SSH_AGENT_PID"}))
+		}
 		os.Exit(0)
 	}
 
-	// avoid multiple start
+	// avoid multiple start unless replacing the running one
 	if serverPid != -1 {
-		log.Printf("wsl2-ssh-agent (pid: %d) is already running; exit", serverPid)
-		fmt.Println(output)
-		os.Exit(0)
+		if !c.shouldReplace(serverPid, parent) {
+			log.Printf("wsl2-ssh-agent (pid: %d) is already running; exit", serverPid)
+			fmt.Println(output(serverPid))
+			os.Exit(0)
+		}
+		log.Printf("replace wsl2-ssh-agent (pid: %d)", serverPid)
+		c.replacePid = serverPid
+		flag.Set("replace", "true")
+	}
+
+	// ssh-agent -D and -d print the environment, and stay in foreground
+	if c.foreground && c.sshAgentMode {
+		fmt.Println(output(os.Getpid()))
 	}
 
 	// daemonize
 	if !c.foreground {
 		if parent {
 			log.Printf("daemonize: start")
-			args := []string{"-socket", c.socketPath}
-			if c.logFile != "" {
-				args = append(args, "-pipename", c.pipeName, "-log", c.logFile)
-			}
-			startDaemonizing(args...)
+			startDaemonizing(c.lock, c.daemonArgs()...)
 		} else {
-			completeDaemonizing(output)
+			completeDaemonizing(output(os.Getpid()))
 			log.Printf("daemonize: completed")
 		}
 	}
 
-	// set up signal handlers
+	return signalContext()
+}
+
+// set up signal handlers
+func signalContext() context.Context {
 	signal.Ignore(syscall.SIGPIPE)
 	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-
 	return ctx
 }
 
+// the options passed to [W] in the handshake
+func (c *config) options() repeaterOptions {
+	return repeaterOptions{PipeName: c.pipeName, PipeTimeout: c.pipeTimeout.Milliseconds(), pipeOrder: c.pipeNames}
+}
+
+// the command-line options passed to the daemon process; it reads the config
+// file and the environment by itself, so that reload-config can tell them from
+// the command line
+func (c *config) daemonArgs() []string {
+	args := []string{"-socket", c.socketPath}
+	flag.Visit(func(f *flag.Flag) {
+		_, explicit := c.commandLine[f.Name]
+		switch f.Name {
+		case "socket", "foreground", "stop", "k", "version":
+		case "replace":
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		default:
+			if explicit {
+				args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+			}
+		}
+	})
+	return args
+}
+
+// the settings of the command line, the config file, and the environment as
+// of now; reload-config applies them to the running daemon
+func (c *config) reread() (*config, error) {
+	fresh := &config{commandLine: c.commandLine}
+	flags := flag.NewFlagSet("wsl2-ssh-agent", flag.ContinueOnError)
+	fresh.defineFlags(flags)
+	explicit := map[string]bool{}
+	for name, value := range c.commandLine {
+		err := flags.Set(name, value)
+		if err != nil {
+			return nil, err
+		}
+		explicit[name] = true
+	}
+	err := applySettings(flags, explicit)
+	if err != nil {
+		return nil, err
+	}
+	fresh.flags = flags
+	fresh.socketPath = c.socketPath
+	fresh.controlPath = c.controlPath
+
+	fresh.script, err = loadRepeaterScript(fresh.repeaterScript)
+	if err != nil {
+		return nil, err
+	}
+	fresh.pipeNames, err = pipeNameOrder(fresh.pipeOrder)
+	if err != nil {
+		return nil, err
+	}
+	if fresh.powershellPath != "" {
+		fresh.powershellPaths = []string{fresh.powershellPath}
+	} else {
+		fresh.powershellPaths, err = powershellPaths(fresh.powershellOrder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fresh.powershellPaths) == 0 {
+		return nil, fmt.Errorf("neither pwsh.exe nor powershell.exe found")
+	}
+	return fresh, nil
+}
+
 func (c *config) setupLogFile() {
 	var logFile *os.File
 
@@ -188,7 +453,7 @@ func (c *config) setupLogFile() {
 			logOutput = io.Discard
 		}
 	}
-	log.SetOutput(logOutput)
+	log.SetOutput(levelGate{logOutput})
 	log.SetPrefix("[L] ")
 }
 
@@ -219,31 +484,10 @@ func findRunningServerPid(path string) int {
 	defer conn.Close()
 
 	// identify the pid of the existing server
-	file, err := conn.(*net.UnixConn).File()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	cred, err := syscall.GetsockoptUcred(int(file.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	cred, err := peerCred(conn)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	return int(cred.Pid)
 }
-
-// stop the running server
-func stopService(pid int) {
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = process.Signal(syscall.SIGTERM)
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = process.Wait()
-	if err != nil {
-		log.Fatal(err)
-	}
-}
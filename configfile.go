@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the options that make no sense to fix in the config file
+var commandLineOnlyFlags = map[string]bool{
+	"config":  true,
+	"stop":    true,
+	"k":       true,
+	"version": true,
+	"replace": true,
+}
+
+// the actions, not settings, which the daemon process would inherit
+var envIgnoredFlags = map[string]bool{
+	"stop":    true,
+	"k":       true,
+	"version": true,
+}
+
+// the config file found in $XDG_CONFIG_HOME or $XDG_CONFIG_DIRS, or "" if none
+func findConfigFile() string {
+	home := os.Getenv("XDG_CONFIG_HOME")
+	if home == "" {
+		dir, err := os.UserHomeDir()
+		if err == nil {
+			home = filepath.Join(dir, ".config")
+		}
+	}
+	dirs := os.Getenv("XDG_CONFIG_DIRS")
+	if dirs == "" {
+		dirs = "/etc/xdg"
+	}
+
+	for _, dir := range append([]string{home}, filepath.SplitList(dirs)...) {
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(dir, "wsl2-ssh-agent", "config")
+		_, err := os.Stat(path)
+		if err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// the flags set in the command line, which win over the config file and the
+// environment
+func explicitFlags(flags *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// apply the config file and the environment to the flags not in explicit; the
+// precedence is the command line, the environment, the config file, and the
+// defaults
+func applySettings(flags *flag.FlagSet, explicit map[string]bool) error {
+	path := flags.Lookup("config").Value.String()
+	envPath, set := os.LookupEnv(envName("config"))
+	if !explicit["config"] && set {
+		// "" disables the config file
+		path = envPath
+	} else if path == "" {
+		path = findConfigFile()
+	}
+	if path != "" {
+		flags.Set("config", path)
+		err := applyConfigFile(flags, path, explicit)
+		if err != nil {
+			return fmt.Errorf("failed to load the config file: %s", err)
+		}
+	}
+	return applyEnvironment(flags, explicit)
+}
+
+// the environment variable of a flag: WSL2_SSH_AGENT_PIPE_TIMEOUT for -pipe-timeout
+func envName(name string) string {
+	return "WSL2_SSH_AGENT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// apply the environment variables to the flags not in explicit; a variable
+// set to "" restores the default, overriding the config file
+func applyEnvironment(flags *flag.FlagSet, explicit map[string]bool) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, set := os.LookupEnv(envName(f.Name))
+		if err != nil || !set || explicit[f.Name] || envIgnoredFlags[f.Name] {
+			return
+		}
+		if value == "" {
+			value = f.DefValue
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: invalid value %q: %s", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
+
+// apply the config file to the flags not in explicit; each line is
+// "name = value" where name is a flag name:
+//
+//	# comment
+//	pipename = pageant
+//	log = "/tmp/wsl2-ssh-agent.log"
+func applyConfigFile(flags *flag.FlagSet, path string, explicit map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		err := applyConfigLine(flags, line, explicit)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func applyConfigLine(flags *flag.FlagSet, line string, explicit map[string]bool) error {
+	name, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return fmt.Errorf("must be \"name = value\": %s", line)
+	}
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+
+	if strings.HasPrefix(value, "\"") {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return fmt.Errorf("broken quoted value of %s: %s", name, value)
+		}
+		value = unquoted
+	}
+
+	if flags.Lookup(name) == nil {
+		return fmt.Errorf("unknown option: %s", name)
+	}
+	if commandLineOnlyFlags[name] {
+		return fmt.Errorf("%s is allowed only in the command line", name)
+	}
+	if explicit[name] {
+		return nil
+	}
+
+	err := flags.Set(name, value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %s", value, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	pipeName := flags.String("pipename", "openssh-ssh-agent", "")
+	logFile := flags.String("log", "", "")
+	heartbeat := flags.Duration("heartbeat", 30*time.Second, "")
+	standby := flags.Bool("standby", false, "")
+	flags.Parse([]string{"-log", "/tmp/cmdline.log"})
+
+	path := writeConfigFile(t, `
+# comment
+pipename = pageant
+log = "/tmp/config file.log"
+  heartbeat=1m
+standby = true
+`)
+	err := applyConfigFile(flags, path, explicitFlags(flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pipeName != "pageant" || *heartbeat != time.Minute || !*standby {
+		t.Errorf("not applied: %s, %v, %v", *pipeName, *heartbeat, *standby)
+	}
+	if *logFile != "/tmp/cmdline.log" {
+		t.Errorf("the command line must win: %s", *logFile)
+	}
+}
+
+func TestApplyConfigFileError(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{"pipename = pageant\nno-such-option = 1\n", ":2: unknown option: no-such-option"},
+		{"\n\nheartbeat = soon\n", `:3: invalid value "soon" for heartbeat`},
+		{"pipename\n", `:1: must be "name = value"`},
+		{"pipename = \"pageant\n", ":1: broken quoted value"},
+		{"config = /tmp/other\n", ":1: config is allowed only in the command line"},
+	}
+	for _, c := range cases {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.String("pipename", "", "")
+		flags.String("config", "", "")
+		flags.Duration("heartbeat", 0, "")
+
+		path := writeConfigFile(t, c.content)
+		err := applyConfigFile(flags, path, nil)
+		if err == nil || !strings.HasPrefix(err.Error(), path+c.expected) {
+			t.Errorf("%q: expected %s%s, got %v", c.content, path, c.expected, err)
+		}
+	}
+}
+
+func TestFindConfigFile(t *testing.T) {
+	home := t.TempDir()
+	system := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("XDG_CONFIG_DIRS", system)
+
+	if path := findConfigFile(); path != "" {
+		t.Errorf("expected none, got %s", path)
+	}
+
+	for _, dir := range []string{system, home} {
+		path := filepath.Join(dir, "wsl2-ssh-agent", "config")
+		os.MkdirAll(filepath.Dir(path), 0700)
+		os.WriteFile(path, nil, 0600)
+		if found := findConfigFile(); found != path {
+			t.Errorf("expected %s, got %s", path, found)
+		}
+	}
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	pipeName := flags.String("pipename", "openssh-ssh-agent", "")
+	logFile := flags.String("log", "", "")
+	pipeTimeout := flags.Duration("pipe-timeout", 3*time.Second, "")
+	stop := flags.Bool("stop", false, "")
+	flags.Parse([]string{"-log", "/tmp/cmdline.log"})
+	explicit := explicitFlags(flags)
+
+	err := applyConfigFile(flags, writeConfigFile(t, "pipename = pageant\npipe-timeout = 5s\n"), explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("WSL2_SSH_AGENT_PIPE_TIMEOUT", "10s")
+	t.Setenv("WSL2_SSH_AGENT_LOG", "/tmp/env.log")
+	t.Setenv("WSL2_SSH_AGENT_STOP", "true")
+	err = applyEnvironment(flags, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pipeName != "pageant" || *pipeTimeout != 10*time.Second || *logFile != "/tmp/cmdline.log" || *stop {
+		t.Errorf("wrong precedence: %s, %v, %s, %v", *pipeName, *pipeTimeout, *logFile, *stop)
+	}
+
+	// an empty value restores the default over the config file
+	t.Setenv("WSL2_SSH_AGENT_PIPENAME", "")
+	err = applyEnvironment(flags, explicit)
+	if err != nil || *pipeName != "openssh-ssh-agent" {
+		t.Errorf("should be the default: %s (%v)", *pipeName, err)
+	}
+
+	t.Setenv("WSL2_SSH_AGENT_PIPE_TIMEOUT", "soon")
+	err = applyEnvironment(flags, explicit)
+	if err == nil || !strings.HasPrefix(err.Error(), `WSL2_SSH_AGENT_PIPE_TIMEOUT: invalid value "soon"`) {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// the control socket is an owner-only UNIX domain socket next to the agent
+// socket; it accepts one JSON command per line and answers one JSON per line:
+//
+//	-> {"command":"set-log-level","args":{"level":"debug"}}
+//	<- {"ok":true,"result":{"level":"debug"}}
+type controlRequest struct {
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+type controlResponse struct {
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+var controlCommands = []string{"status", "stats", "config", "restart-repeater", "reload-config", "discard-standby", "list-clients", "set-log-level", "handover"}
+
+// an ssh client connected to the agent socket
+type clientInfo struct {
+	ID          int       `json:"id"`
+	Pid         int       `json:"pid"`
+	UID         int       `json:"uid"`
+	Command     string    `json:"command"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Requests    int       `json:"requests"`
+}
+
+func listenControl(path string) (net.Listener, error) {
+	// the daemon is not running here, so the socket is a leftover of a crash
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove %s: %s", path, err)
+	}
+
+	mask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// the credentials of the process on the other side of a UNIX domain socket
+func peerCred(conn net.Conn) (*syscall.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a UNIX domain socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+func (s *server) serveControl(ctx context.Context) {
+	for {
+		conn, err := s.control.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("failed to accept on the control socket: %s", err)
+			}
+			return
+		}
+
+		cred, err := peerCred(conn)
+		if err != nil || int(cred.Uid) != os.Getuid() {
+			log.Printf("control: refused a connection from another user")
+			conn.Close()
+			continue
+		}
+
+		go s.controlClient(ctx, conn)
+	}
+}
+
+func (s *server) controlClient(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req controlRequest
+		var result interface{}
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err == nil {
+			log.Printf("control: %s", req.Command)
+			result, err = s.handleControl(ctx, &req)
+		}
+
+		resp := controlResponse{OK: err == nil}
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result, err = json.Marshal(result)
+			if err != nil {
+				resp = controlResponse{Error: err.Error()}
+			}
+		}
+		if enc.Encode(resp) != nil {
+			return
+		}
+
+		// exit after the new daemon knows that the sockets are handed over
+		if req.Command == "handover" && resp.OK {
+			s.cancel()
+			return
+		}
+	}
+}
+
+func (s *server) handleControl(ctx context.Context, req *controlRequest) (interface{}, error) {
+	switch req.Command {
+	case "status":
+		return s.status(), nil
+	case "stats":
+		s.health.Lock()
+		defer s.health.Unlock()
+		return s.health.stats, nil
+	case "config":
+		return s.currentSettings(), nil
+	case "handover":
+		// stop accepting and exit, leaving the sockets to the new daemon
+		atomic.StoreInt32(&s.handedOver, 1)
+		log.Printf("hand over %s to a new daemon", s.socketPath)
+		return nil, nil
+	case "restart-repeater":
+		err := s.inLoop(ctx, func(rep *repeater) *repeater {
+			if rep != nil {
+				rep.terminate()
+				log.Printf("[W] terminated; restart")
+			}
+			s.discardStandby()
+			return s.connect(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s.status(), nil
+	case "reload-config":
+		return s.reloadConfig(ctx)
+	case "discard-standby":
+		return map[string]bool{"standby": s.discardStandby()}, nil
+	case "list-clients":
+		return s.listClients(), nil
+	case "set-log-level":
+		level, ok := parseLogLevel(req.Args["level"])
+		if !ok {
+			return nil, fmt.Errorf("unknown log level: %q (must be debug, info, warning, or error)", req.Args["level"])
+		}
+		atomic.StoreInt32(&minLogLevel, int32(level))
+		return map[string]string{"level": level.String()}, nil
+	}
+	return nil, fmt.Errorf("unknown command: %q (must be %s)", req.Command, strings.Join(controlCommands, ", "))
+}
+
+// run a function in the server loop, which owns the current repeater
+func (s *server) inLoop(ctx context.Context, run func(rep *repeater) *repeater) error {
+	task := loopTask{run: run, done: make(chan struct{})}
+	select {
+	case s.tasks <- task:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-task.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// the options that reload-config applies to the running daemon; the others
+// take effect when the daemon is restarted
+var liveFlags = map[string]bool{
+	"powershell-path":   true,
+	"powershell-order":  true,
+	"repeater-script":   true,
+	"pipename":          true,
+	"pipename-order":    true,
+	"pipe-timeout":      true,
+	"heartbeat":         true,
+	"heartbeat-misses":  true,
+	"idle-timeout":      true,
+	"retry-initial":     true,
+	"retry-max":         true,
+	"retry-jitter":      true,
+	"breaker-threshold": true,
+}
+
+// the options that [W] is invoked with
+var repeaterFlags = map[string]bool{
+	"powershell-path":  true,
+	"powershell-order": true,
+	"repeater-script":  true,
+	"pipename":         true,
+	"pipename-order":   true,
+	"pipe-timeout":     true,
+}
+
+// read the config file, the environment, and the repeater script again, and
+// apply the changed options that are in liveFlags; [W] is restarted if the
+// way to invoke it is changed
+func (s *server) reloadConfig(ctx context.Context) (interface{}, error) {
+	c, err := s.reread()
+	if err != nil {
+		return nil, err
+	}
+	settings := c.settings()
+
+	s.reloadLock.Lock()
+	applied, ignored := []string{}, []string{}
+	for name, value := range settings {
+		if s.settings[name] == value {
+			continue
+		}
+		if liveFlags[name] {
+			applied = append(applied, name)
+			s.settings[name] = value
+		} else {
+			ignored = append(ignored, name)
+		}
+	}
+	if c.script != s.script && !contains(applied, "repeater-script") {
+		applied = append(applied, "repeater-script")
+	}
+	restart := false
+	for _, name := range applied {
+		restart = restart || repeaterFlags[name]
+	}
+	if restart {
+		s.powershellPaths = c.powershellPaths
+		s.scriptPath = c.repeaterScript
+		s.script = c.script
+		s.options = c.options()
+	}
+	s.reloadLock.Unlock()
+	sort.Strings(applied)
+	sort.Strings(ignored)
+
+	if len(applied) > 0 {
+		log.Printf("reload-config: applied %s", strings.Join(applied, ", "))
+	}
+	if len(ignored) > 0 {
+		log.Printf("reload-config: restart the daemon to apply %s", strings.Join(ignored, ", "))
+	}
+	if restart {
+		logScript(c.repeaterScript, c.script)
+	}
+
+	// the server loop owns these settings and the repeater
+	err = s.inLoop(ctx, func(rep *repeater) *repeater {
+		s.heartbeat = c.heartbeat
+		s.heartbeatMisses = c.heartbeatMisses
+		s.idleTimeout = c.idleTimeout
+		s.breaker.policy = c.retry
+		if !restart {
+			return rep
+		}
+		s.discardStandby()
+		if rep == nil {
+			return nil
+		}
+		rep.terminate()
+		log.Printf("[W] terminated; restart with the new options")
+		return s.connect(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"script":    c.repeaterScript,
+		"sha256":    fmt.Sprintf("%x", sha256.Sum256([]byte(c.script))),
+		"applied":   applied,
+		"ignored":   ignored,
+		"restarted": restart,
+	}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) addClient(conn net.Conn) *clientInfo {
+	client := &clientInfo{Pid: -1, UID: -1, ConnectedAt: time.Now()}
+	cred, err := peerCred(conn)
+	if err == nil {
+		client.Pid = int(cred.Pid)
+		client.UID = int(cred.Uid)
+		comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", cred.Pid))
+		if err == nil {
+			client.Command = strings.TrimSpace(string(comm))
+		}
+	}
+
+	s.clients.Lock()
+	defer s.clients.Unlock()
+	s.clients.nextID += 1
+	client.ID = s.clients.nextID
+	s.clients.m[client.ID] = client
+	return client
+}
+
+func (s *server) removeClient(client *clientInfo) {
+	s.clients.Lock()
+	defer s.clients.Unlock()
+	delete(s.clients.m, client.ID)
+}
+
+func (s *server) clientCount() int {
+	s.clients.Lock()
+	defer s.clients.Unlock()
+	return len(s.clients.m)
+}
+
+func (s *server) listClients() []clientInfo {
+	s.clients.Lock()
+	defer s.clients.Unlock()
+
+	list := []clientInfo{}
+	for _, client := range s.clients.m {
+		list = append(list, *client)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+var errNotRunning = errors.New("wsl2-ssh-agent is not running")
+
+// send a command to the control socket of the running daemon
+func controlCall(path string, req controlRequest, result interface{}) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return errNotRunning
+		}
+		return fmt.Errorf("failed to connect to %s: %s", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %s", req.Command, err)
+	}
+
+	var resp controlResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return fmt.Errorf("failed to receive the result of %s: %s", req.Command, err)
+	}
+	if !resp.OK {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// the ctl command: "ctl <command> [key=value...]" prints the result in JSON
+func runCtl(c *config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: wsl2-ssh-agent ctl <command> [key=value...]\ncommands: %s\n", strings.Join(controlCommands, ", "))
+		return 2
+	}
+
+	req := controlRequest{Command: args[0], Args: map[string]string{}}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "argument must be key=value: %s\n", arg)
+			return 2
+		}
+		req.Args[key] = value
+	}
+
+	var result json.RawMessage
+	err := controlCall(c.controlPath, req, &result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printJSON(os.Stdout, result)
+	return 0
+}
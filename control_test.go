@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	path := setupDummyServer(t)
+	ctl := path + ".ctl"
+
+	info, err := os.Stat(ctl)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the control socket should be owner-only: %v (%v)", info.Mode(), err)
+	}
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	pid := requestPid(t, sock)
+
+	var clients []clientInfo
+	err = controlCall(ctl, controlRequest{Command: "list-clients"}, &clients)
+	if err != nil || len(clients) != 1 || clients[0].Pid != os.Getpid() || clients[0].Requests != 1 {
+		t.Errorf("wrong clients: %+v (%v)", clients, err)
+	}
+
+	var st stats
+	err = controlCall(ctl, controlRequest{Command: "stats"}, &st)
+	if err != nil || st.Connections != 1 || st.Requests != 1 || st.BytesIn != 4+3 {
+		t.Errorf("wrong stats: %+v (%v)", st, err)
+	}
+
+	err = controlCall(ctl, controlRequest{Command: "restart-repeater"}, nil)
+	if err != nil {
+		t.Errorf("failed to restart: %v", err)
+	}
+	if requestPid(t, sock) == pid {
+		t.Errorf("PowerShell should be restarted")
+	}
+
+	discarded := map[string]bool{}
+	err = controlCall(ctl, controlRequest{Command: "discard-standby"}, &discarded)
+	if err != nil || discarded["standby"] {
+		t.Errorf("there should be no standby to discard: %v (%v)", discarded, err)
+	}
+
+	defer atomic.StoreInt32(&minLogLevel, atomic.LoadInt32(&minLogLevel))
+	err = controlCall(ctl, controlRequest{Command: "set-log-level", Args: map[string]string{"level": "debug"}}, nil)
+	if err != nil || logLevel(atomic.LoadInt32(&minLogLevel)) != levelDebug {
+		t.Errorf("failed to set the log level: %v", err)
+	}
+	err = controlCall(ctl, controlRequest{Command: "set-log-level", Args: map[string]string{"level": "verbose"}}, nil)
+	if err == nil {
+		t.Errorf("should fail")
+	}
+
+	err = controlCall(ctl, controlRequest{Command: "shutdown"}, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "unknown command") {
+		t.Errorf("should fail: %v", err)
+	}
+}
+
+func TestControlReloadConfig(t *testing.T) {
+	var scriptPath, configPath string
+	path := setupDummyServer(t, func(c *config) {
+		dir := filepath.Dir(c.socketPath)
+		scriptPath = filepath.Join(dir, "repeater.ps1")
+		err := os.WriteFile(scriptPath, []byte(repeaterPs1), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configPath = filepath.Join(dir, "config")
+		err = os.WriteFile(configPath, []byte("pipename = dummy-pipe-name\nrepeater-script = "+scriptPath+"\n"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// as if started with -config
+		socketPath, powershellPaths := c.socketPath, c.powershellPaths
+		c.commandLine = map[string]string{"config": configPath}
+		c.flags = flag.NewFlagSet("test", flag.ContinueOnError)
+		c.defineFlags(c.flags)
+		c.flags.Set("config", configPath)
+		err = applySettings(c.flags, map[string]bool{"config": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.socketPath, c.controlPath, c.powershellPaths = socketPath, socketPath+".ctl", powershellPaths
+	})
+	ctl := path + ".ctl"
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	pid := requestPid(t, sock)
+
+	result := struct {
+		Applied   []string `json:"applied"`
+		Ignored   []string `json:"ignored"`
+		Restarted bool     `json:"restarted"`
+	}{}
+	err = controlCall(ctl, controlRequest{Command: "reload-config"}, &result)
+	if err != nil || len(result.Applied) != 0 || len(result.Ignored) != 0 || result.Restarted {
+		t.Errorf("should not be changed: %v (%v)", result, err)
+	}
+
+	// the dummy reads the script of the same length
+	err = os.WriteFile(scriptPath, []byte(strings.Replace(repeaterPs1, "MainLoop", "mainLoop", 1)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = controlCall(ctl, controlRequest{Command: "reload-config"}, &result)
+	if err != nil || fmt.Sprint(result.Applied) != "[repeater-script]" || !result.Restarted {
+		t.Errorf("should be changed: %v (%v)", result, err)
+	}
+	newPid := requestPid(t, sock)
+	if newPid == pid {
+		t.Errorf("PowerShell should be restarted with the new script")
+	}
+
+	// -standby needs a restart of the daemon
+	err = os.WriteFile(configPath, []byte("pipename = dummy-pipe-name\nrepeater-script = "+scriptPath+"\nheartbeat = 1m\nstandby = true\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = controlCall(ctl, controlRequest{Command: "reload-config"}, &result)
+	if err != nil || fmt.Sprint(result.Applied) != "[heartbeat]" || fmt.Sprint(result.Ignored) != "[standby]" || result.Restarted {
+		t.Errorf("should apply only -heartbeat: %v (%v)", result, err)
+	}
+	if requestPid(t, sock) != newPid {
+		t.Errorf("PowerShell should not be restarted")
+	}
+
+	settings := map[string]string{}
+	err = controlCall(ctl, controlRequest{Command: "config"}, &settings)
+	if err != nil || settings["heartbeat"] != "1m0s" || settings["standby"] != "false" {
+		t.Errorf("wrong settings: %v (%v)", settings, err)
+	}
+}
@@ -23,8 +23,8 @@ func checkDaemonMode() bool {
 	return parent
 }
 
-// invoke itself as a child process
-func startDaemonizing(args ...string) {
+// invoke itself as a child process, passing the lock if any
+func startDaemonizing(lock *os.File, args ...string) {
 	r, w, err := os.Pipe()
 	if err != nil {
 		log.Fatal(err)
@@ -38,6 +38,9 @@ func startDaemonizing(args ...string) {
 	// invoke itself
 	cmd := exec.Command(exe, args...)
 	cmd.ExtraFiles = []*os.File{w}
+	if lock != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, lock)
+	}
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 
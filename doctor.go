@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// where WSL registers the interpreter of Windows executables
+var binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// PowerShell taking longer than this to start is reported as slow
+var slowStartup = 5 * time.Second
+
+// the doctor command checks each link from ssh to ssh-agent.exe in turn, and
+// prints a pass/fail report with hints
+type doctor struct {
+	w        io.Writer
+	failures int
+}
+
+func (d *doctor) report(status string, name string, detail string, hint string) {
+	fmt.Fprintf(d.w, "[%-4s] %s: %s\n", status, name, detail)
+	if hint != "" {
+		fmt.Fprintf(d.w, "       hint: %s\n", hint)
+	}
+	if status == "FAIL" {
+		d.failures += 1
+	}
+}
+
+func runDoctor(c *config, w io.Writer) int {
+	d := &doctor{w: w}
+
+	d.checkInterop()
+	rep := d.checkPowerShell(c)
+	if rep != nil {
+		d.checkAgentService(rep)
+		d.checkPipe(rep)
+		d.checkIdentities(rep)
+		rep.terminate()
+	}
+	d.checkSocket(c)
+	d.checkDaemon(c)
+	d.checkEnvironment(c)
+
+	if d.failures > 0 {
+		fmt.Fprintf(w, "%d check(s) failed\n", d.failures)
+		return 1
+	}
+	fmt.Fprintf(w, "all checks passed\n")
+	return 0
+}
+
+func (d *doctor) checkInterop() {
+	for _, name := range []string{"WSLInterop", "WSLInterop-late"} {
+		path := filepath.Join(binfmtDir, name)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(string(buf), "enabled") {
+			d.report("OK", "WSL interop", fmt.Sprintf("enabled (%s)", path), "")
+		} else {
+			d.report("FAIL", "WSL interop", fmt.Sprintf("disabled (%s)", path), "run `echo 1 | sudo tee "+path+"`, or set `[interop] enabled=true` in /etc/wsl.conf and run `wsl.exe --shutdown`")
+		}
+		return
+	}
+	d.report("FAIL", "WSL interop", "not registered in "+binfmtDir, "Windows executables cannot run; set `[interop] enabled=true` in /etc/wsl.conf and run `wsl.exe --shutdown`")
+}
+
+// start [W] in the first working interpreter; the caller terminates it
+func (d *doctor) checkPowerShell(c *config) *repeater {
+	if len(c.powershellPaths) == 0 {
+		d.report("FAIL", "PowerShell", "neither pwsh.exe nor powershell.exe found", "use -powershell-path to specify the path")
+		return nil
+	}
+	d.report("OK", "PowerShell", strings.Join(c.powershellPaths, ", "), "")
+
+	for _, powershell := range c.powershellPaths {
+		start := time.Now()
+		rep, err := startRepeater(powershell, c.script, c.options(), waitTimes[len(waitTimes)-1])
+		elapsed := time.Since(start).Round(time.Millisecond)
+		name := filepath.Base(powershell)
+
+		if errors.Is(err, errIncompatibleScript) {
+			d.report("FAIL", "repeater handshake", err.Error(), "the -repeater-script is for another version; start from `wsl2-ssh-agent dump-script`")
+			return nil
+		}
+		if err != nil {
+			d.report("FAIL", "PowerShell startup", err.Error(), "run `"+name+" -Command 1` to see if it works at all")
+			continue
+		}
+
+		if elapsed > slowStartup {
+			d.report("WARN", "PowerShell startup", fmt.Sprintf("%s took %v", name, elapsed), "antivirus may slow it down; -standby hides the delay")
+		} else {
+			d.report("OK", "PowerShell startup", fmt.Sprintf("%s took %v", name, elapsed), "")
+		}
+		d.report("OK", "repeater handshake", fmt.Sprintf("protocol %d, PowerShell %s (%s)", rep.info.Protocol, rep.info.PSVersion, rep.info.PSEdition), "")
+		return rep
+	}
+	return nil
+}
+
+func (d *doctor) checkAgentService(rep *repeater) {
+	switch rep.info.SSHAgentService {
+	case "Running":
+		d.report("OK", "ssh-agent service", fmt.Sprintf("running (ssh-agent.exe %s)", rep.info.SSHAgentVersion), "")
+	case "":
+		d.report("WARN", "ssh-agent service", "not installed", "install the OpenSSH Client feature of Windows, unless another agent serves -pipename")
+	default:
+		d.report("WARN", "ssh-agent service", strings.ToLower(rep.info.SSHAgentService), "run `Start-Service ssh-agent` in an elevated PowerShell, unless another agent serves -pipename")
+	}
+}
+
+func (d *doctor) checkPipe(rep *repeater) {
+	if rep.info.Pipe == "ok" {
+		d.report("OK", "named pipe", rep.info.PipeName, "")
+		return
+	}
+	d.report("FAIL", "named pipe", fmt.Sprintf("%s (%s)", rep.info.PipeName, rep.info.Pipe), (&pipeError{Code: rep.info.Pipe}).advice(rep.info.PipeName))
+}
+
+// the number of keys in SSH_AGENT_IDENTITIES_ANSWER
+func countIdentities(resp []byte) (int, error) {
+	if len(resp) < 5 {
+		return 0, fmt.Errorf("too short reply from the agent")
+	}
+	if len(resp) < 9 || resp[4] != agentIdentitiesAnswer {
+		return 0, fmt.Errorf("unexpected reply from the agent (type %d)", resp[4])
+	}
+	return int(binary.BigEndian.Uint32(resp[5:9])), nil
+}
+
+func (d *doctor) checkIdentities(rep *repeater) {
+	start := time.Now()
+	_, err := rep.in.Write(appendString(nil, []byte{agentcRequestIdentities}))
+	if err != nil {
+		d.report("FAIL", "REQUEST_IDENTITIES via [W]", err.Error(), "")
+		return
+	}
+	rep.setReadDeadline(time.Now().Add(readTimeLimit))
+	resp, err := rep.readReply()
+	rep.setReadDeadline(time.Time{})
+	if err != nil {
+		d.report("FAIL", "REQUEST_IDENTITIES via [W]", err.Error(), "run with -verbose to see the log of [W]")
+		return
+	}
+	if perr, ok := parsePipeError(resp); ok {
+		d.report("FAIL", "REQUEST_IDENTITIES via [W]", perr.Code, perr.advice(rep.info.PipeName))
+		return
+	}
+	n, err := countIdentities(resp)
+	if err != nil {
+		d.report("FAIL", "REQUEST_IDENTITIES via [W]", err.Error(), "")
+		return
+	}
+	d.report("OK", "REQUEST_IDENTITIES via [W]", fmt.Sprintf("%d key(s) in %v", n, time.Since(start).Round(time.Millisecond)), noKeysHint(n))
+}
+
+func noKeysHint(n int) string {
+	if n == 0 {
+		return "the agent has no key; run `ssh-add` on Windows"
+	}
+	return ""
+}
+
+func (d *doctor) checkSocket(c *config) {
+	dir := filepath.Dir(c.socketPath)
+	info, err := os.Stat(dir)
+	if err != nil {
+		d.report("FAIL", "socket directory", err.Error(), "create it, or use -socket")
+		return
+	}
+	if info.Mode().Perm()&0022 != 0 && info.Mode()&os.ModeSticky == 0 {
+		d.report("WARN", "socket directory", fmt.Sprintf("%s is writable by others (%v)", dir, info.Mode().Perm()), "run `chmod go-w "+dir+"`")
+	} else {
+		d.report("OK", "socket directory", fmt.Sprintf("%s (%v)", dir, info.Mode().Perm()), "")
+	}
+
+	// left by an interrupted -replace
+	leftovers, _ := filepath.Glob(c.socketPath + ".[0-9]*")
+	if len(leftovers) > 0 {
+		d.report("WARN", "stale sockets", strings.Join(leftovers, ", "), "remove them")
+	}
+
+	info, err = os.Lstat(c.socketPath)
+	if err != nil {
+		// checked in checkDaemon
+		return
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		d.report("FAIL", "socket", c.socketPath+" is not a socket", "remove it, or use -socket")
+		return
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		d.report("FAIL", "socket", fmt.Sprintf("%s is owned by uid %d", c.socketPath, stat.Uid), "use a socket in your own directory with -socket")
+		return
+	}
+
+	conn, err := net.Dial("unix", c.socketPath)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			d.report("FAIL", "socket", c.socketPath+" is stale", "remove it, or just start wsl2-ssh-agent, which removes it")
+		} else {
+			d.report("FAIL", "socket", err.Error(), "")
+		}
+		return
+	}
+	conn.Close()
+	d.report("OK", "socket", c.socketPath, "")
+}
+
+func (d *doctor) checkDaemon(c *config) {
+	st, err := queryStatus(c.controlPath)
+	if err != nil {
+		if errors.Is(err, errNotRunning) {
+			d.report("FAIL", "daemon", "not running", "add `eval $(wsl2-ssh-agent)` to your shell's rc file")
+		} else {
+			d.report("FAIL", "daemon", err.Error(), "")
+		}
+		return
+	}
+	d.report("OK", "daemon", fmt.Sprintf("pid %d, repeater %s", st.Pid, st.Repeater), "")
+
+	conn, err := dialAgent(c.socketPath)
+	if err != nil {
+		d.report("FAIL", "REQUEST_IDENTITIES via daemon", err.Error(), "")
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	ids, err := listIdentities(conn)
+	if err != nil {
+		d.report("FAIL", "REQUEST_IDENTITIES via daemon", err.Error(), "see `wsl2-ssh-agent status`")
+		return
+	}
+	d.report("OK", "REQUEST_IDENTITIES via daemon", fmt.Sprintf("%d key(s) in %v", len(ids), time.Since(start).Round(time.Millisecond)), noKeysHint(len(ids)))
+}
+
+func (d *doctor) checkEnvironment(c *config) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	switch sock {
+	case c.socketPath:
+		d.report("OK", "SSH_AUTH_SOCK", sock, "")
+	case "":
+		d.report("FAIL", "SSH_AUTH_SOCK", "not set", "add `eval $(wsl2-ssh-agent)` to your shell's rc file")
+	default:
+		d.report("WARN", "SSH_AUTH_SOCK", fmt.Sprintf("%s, not %s", sock, c.socketPath), "another agent is used; check your shell's rc file")
+	}
+}
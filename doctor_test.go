@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	var c *config
+	path := setupDummyServer(t, func(sc *config) {
+		// answer SSH_AGENT_IDENTITIES_ANSWER with no key
+		dummy := "#!/usr/bin/ruby\n$stdout.sync = true\n" + dummyHandshake(protocolVersion) + `
+loop do
+	len = $stdin.read(4)
+	$stdin.read(len.unpack1("N"))
+	$stdout << "\x00\x00\x00\x05\x0c\x00\x00\x00\x00" # SSH_AGENT_IDENTITIES_ANSWER
+end
+`
+		err := os.WriteFile(filepath.Join(filepath.Dir(sc.socketPath), "powershell.exe"), []byte(dummy), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c = sc
+	})
+
+	binfmtDirBackup := binfmtDir
+	binfmtDir = t.TempDir()
+	t.Cleanup(func() {
+		binfmtDir = binfmtDirBackup
+	})
+	err := os.WriteFile(filepath.Join(binfmtDir, "WSLInterop"), []byte("enabled\ninterpreter /init\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSH_AUTH_SOCK", path)
+
+	out := &bytes.Buffer{}
+	if runDoctor(c, out) != 0 {
+		t.Errorf("all checks should pass:\n%s", out)
+	}
+	for _, line := range []string{
+		"[OK  ] WSL interop: enabled",
+		fmt.Sprintf("[OK  ] repeater handshake: protocol %d", protocolVersion),
+		"[OK  ] ssh-agent service: running",
+		"[OK  ] named pipe: dummy-pipe-name",
+		"[OK  ] REQUEST_IDENTITIES via [W]: 0 key(s)",
+		"[OK  ] REQUEST_IDENTITIES via daemon: 0 key(s)",
+		"[OK  ] SSH_AUTH_SOCK: " + path,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("should report %q:\n%s", line, out)
+		}
+	}
+
+	os.Remove(filepath.Join(binfmtDir, "WSLInterop"))
+	t.Setenv("SSH_AUTH_SOCK", "")
+	out.Reset()
+	if runDoctor(c, out) != 1 || !strings.Contains(out.String(), "2 check(s) failed") {
+		t.Errorf("interop and SSH_AUTH_SOCK should fail:\n%s", out)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// the exec command: run a command with SSH_AUTH_SOCK of a private bridge, which
+// is torn down when the command exits, or of the running daemon with -reuse
+func runExec(c *config, args []string) int {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+	reuse := flags.Bool("reuse", false, "use the running daemon if any, instead of a private bridge")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: wsl2-ssh-agent exec [-reuse] [--] command [args...]\n")
+		return 2
+	}
+
+	c.setupLogFile()
+	signal.Ignore(syscall.SIGPIPE)
+
+	if *reuse {
+		pid := c.daemonPid(findRunningServerPid(c.socketPath))
+		if pid != -1 {
+			log.Printf("exec: use wsl2-ssh-agent (pid: %d)", pid)
+			return runCommand(flags.Args(), c.socketPath, pid)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "wsl2-ssh-agent-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	c.socketPath = filepath.Join(dir, "agent.sock")
+	c.controlPath = c.socketPath + ".ctl"
+	s := newServer(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	code := runCommand(flags.Args(), c.socketPath, os.Getpid())
+
+	// terminate [W] and remove the socket
+	cancel()
+	<-done
+	return code
+}
+
+// run the command with the agent, and return its exit code like a shell
+func runCommand(argv []string, socketPath string, agentPid int) int {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socketPath, "SSH_AGENT_PID="+strconv.Itoa(agentPid))
+
+	err := cmd.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 127
+	}
+	log.Printf("exec: %s (pid: %d)", argv[0], cmd.Process.Pid)
+
+	// the command gets SIGINT from the terminal by itself; pass the others
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGINT {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+	defer func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	var c *config
+	path := setupDummyServer(t, func(cc *config) { c = cc })
+	out := filepath.Join(t.TempDir(), "out")
+
+	// a private socket, removed after the command exits
+	private := *c
+	code := runExec(&private, []string{"--", "/bin/sh", "-c", `test -S "$SSH_AUTH_SOCK" && echo "$SSH_AUTH_SOCK" > ` + out + `; exit 3`})
+	if code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	buf, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := strings.TrimSpace(string(buf))
+	if sock == path || !strings.HasSuffix(sock, "agent.sock") {
+		t.Errorf("expected a private socket, got %s", sock)
+	}
+	_, err = os.Stat(filepath.Dir(sock))
+	if !os.IsNotExist(err) {
+		t.Errorf("the private socket must be removed: %v", err)
+	}
+
+	// the running daemon
+	reused := *c
+	code = runExec(&reused, []string{"-reuse", "/bin/sh", "-c", `echo "$SSH_AUTH_SOCK" > ` + out})
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	buf, _ = os.ReadFile(out)
+	if strings.TrimSpace(string(buf)) != path {
+		t.Errorf("expected %s, got %s", path, buf)
+	}
+
+	code = runExec(&reused, []string{"-reuse", "--", "no-such-command"})
+	if code != 127 {
+		t.Errorf("expected exit code 127, got %d", code)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// the version of the protocol between [L] and [W]; it must match the one in
+// repeater.ps1
+const protocolVersion = 3
+
+var errIncompatibleScript = errors.New("incompatible repeater script")
+
+// what [W] reports in the handshake
+type repeaterInfo struct {
+	Protocol                int    `json:"protocol"`
+	PSVersion               string `json:"psVersion"`
+	PSEdition               string `json:"psEdition"`
+	SSHAgentVersion         string `json:"sshAgentVersion"`
+	SSHAgentService         string `json:"sshAgentService"` // Running, Stopped, etc.; empty if not installed
+	IgnoreOpenSSHExtensions bool   `json:"ignoreOpenSSHExtensions"`
+	User                    string `json:"user"`
+	PipeName                string `json:"pipeName"`
+	Pipe                    string `json:"pipe"`
+}
+
+// what [L] passes to [W] in the handshake
+type repeaterOptions struct {
+	PipeName       string   `json:"pipeName"`
+	PipeCandidates []string `json:"pipeCandidates,omitempty"` // patterns to look for, in order, instead of PipeName
+	PipeTimeout    int64    `json:"pipeTimeout"`              // in milliseconds
+
+	pipeOrder []string // candidates of "-pipename auto"; not sent to [W]
+}
+
+// the handshake after [W] outputs "\xff":
+//
+//	[W] -> [L]: hello   (protocol version and what [W] found)
+//	[L] -> [W]: options (pipe name or patterns to look for, and timeout)
+//	[W] -> [L]: ready   (the pipe name and its reachability)
+//
+// each of them is a JSON with a uint32 length header, like ssh-agent messages
+func (rep *repeater) handshake(options repeaterOptions, limit time.Duration) error {
+	rep.setReadDeadline(time.Now().Add(limit))
+	defer rep.setReadDeadline(time.Time{})
+
+	// only a protocol mismatch is fatal; a slow or broken start is retried
+	// like any other, including the script of protocol 1, which sends nothing
+	// and waits for the pipe name
+	err := readJSONMessage(rep.out, &rep.info)
+	if err != nil {
+		return fmt.Errorf("failed to receive hello from [W] (the script may be for an older wsl2-ssh-agent): %s", err)
+	}
+	if rep.info.Protocol != protocolVersion {
+		return fmt.Errorf("%w: [W] speaks protocol %d, but wsl2-ssh-agent %s requires %d", errIncompatibleScript, rep.info.Protocol, version, protocolVersion)
+	}
+
+	// [W] enumerates the pipes only to resolve "auto" or a preset
+	name := options.PipeName
+	options.PipeCandidates, options.PipeName = pipeCandidates(name, options.pipeOrder, rep.info.User)
+
+	err = writeJSONMessage(rep.in, options)
+	if err != nil {
+		return fmt.Errorf("failed to give [W] the options: %s", err)
+	}
+
+	ready := struct {
+		PipeName string `json:"pipeName"`
+		Pipe     string `json:"pipe"`
+	}{}
+	err = readJSONMessage(rep.out, &ready)
+	if err != nil {
+		return fmt.Errorf("failed to receive ready from [W]: %s", err)
+	}
+	rep.info.PipeName = ready.PipeName
+	rep.info.Pipe = ready.Pipe
+	if rep.info.PipeName == "" {
+		rep.info.PipeName = options.PipeName
+	}
+	if options.PipeCandidates != nil {
+		if rep.info.Pipe == "ok" {
+			log.Printf("named pipe: %s -> %s", name, rep.info.PipeName)
+		} else {
+			log.Printf("named pipe: %s -> no pipe found; try %s", name, rep.info.PipeName)
+		}
+	}
+
+	return nil
+}
+
+// [W] replies this instead of the response of ssh-agent.exe when it cannot
+// connect the named pipe: 0xf1 followed by a JSON
+const pipeErrorType = 0xf1
+
+type pipeError struct {
+	Code    string `json:"error"` // missing, denied, busy, timeout, or error
+	Message string `json:"message"`
+}
+
+func parsePipeError(resp []byte) (*pipeError, bool) {
+	if len(resp) < 5 || resp[4] != pipeErrorType {
+		return nil, false
+	}
+	perr := &pipeError{}
+	err := json.Unmarshal(resp[5:], perr)
+	if err != nil {
+		perr.Code = "error"
+		perr.Message = fmt.Sprintf("malformed pipe error from [W]: %s", err)
+	}
+	return perr, true
+}
+
+// what the user should do
+func (perr *pipeError) advice(pipeName string) string {
+	switch perr.Code {
+	case "missing":
+		return fmt.Sprintf("the named pipe %s does not exist; start the \"OpenSSH Authentication Agent\" service (Start-Service ssh-agent in an elevated PowerShell) or check -pipename", pipeName)
+	case "denied":
+		return fmt.Sprintf("access to the named pipe %s is denied; the agent may be running as another user (%s)", pipeName, perr.Message)
+	case "busy":
+		return fmt.Sprintf("the named pipe %s is busy; another client may be holding the agent (%s)", pipeName, perr.Message)
+	}
+	return fmt.Sprintf("failed to connect to the named pipe %s: %s (%s)", pipeName, perr.Code, perr.Message)
+}
+
+func writeJSONMessage(to io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err = to.Write(append(buf, body...))
+	return err
+}
+
+func readJSONMessage(from io.Reader, v interface{}) error {
+	msg, err := readMessage(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg[4:], v)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the messages of ssh-agent protocol used by the keys and test-sign commands
+const (
+	agentFailure            = 5
+	agentcRequestIdentities = 11
+	agentIdentitiesAnswer   = 12
+	agentcSignRequest       = 13
+	agentSignResponse       = 14
+
+	// the flag of SSH_AGENTC_SIGN_REQUEST to get an rsa-sha2-256 signature
+	agentRSASHA256 = 2
+)
+
+// a key that the agent has
+type identity struct {
+	blob    []byte
+	comment string
+}
+
+// "SHA256:..." as ssh-keygen -l shows
+func (id *identity) fingerprint() string {
+	sum := sha256.Sum256(id.blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func (id *identity) keyType() string {
+	keyType, _, err := readString(id.blob)
+	if err != nil {
+		return "unknown"
+	}
+	return string(keyType)
+}
+
+// the size and the type like "256 ... (ED25519)" of ssh-add -l
+func (id *identity) describe() string {
+	bits := 0
+	label := strings.ToUpper(id.keyType())
+	pub, err := parsePublicKey(id.blob)
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		bits, label = 256, "ED25519"
+	case *rsa.PublicKey:
+		bits, label = pub.N.BitLen(), "RSA"
+	case *ecdsa.PublicKey:
+		bits, label = pub.Curve.Params().BitSize, "ECDSA"
+	}
+	if err != nil {
+		return fmt.Sprintf("? %s %s (%s)", id.fingerprint(), id.comment, label)
+	}
+	return fmt.Sprintf("%d %s %s (%s)", bits, id.fingerprint(), id.comment, label)
+}
+
+// the strings of SSH wire format: uint32 length and bytes
+func readString(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, errors.New("truncated message")
+	}
+	n := binary.BigEndian.Uint32(buf)
+	if uint64(len(buf)-4) < uint64(n) {
+		return nil, nil, errors.New("truncated message")
+	}
+	return buf[4 : 4+n], buf[4+n:], nil
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	return append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	return append(appendUint32(buf, uint32(len(s))), s...)
+}
+
+// send a request to the agent and read the reply with readMessage
+func agentCall(conn io.ReadWriter, body []byte) ([]byte, error) {
+	_, err := conn.Write(appendString(nil, body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 5 {
+		return nil, errors.New("empty reply from the agent")
+	}
+	if resp[4] == agentFailure {
+		return nil, errors.New("the agent returned SSH_AGENT_FAILURE")
+	}
+	return resp[4:], nil
+}
+
+func listIdentities(conn io.ReadWriter) ([]identity, error) {
+	resp, err := agentCall(conn, []byte{agentcRequestIdentities})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != agentIdentitiesAnswer || len(resp) < 5 {
+		return nil, fmt.Errorf("unexpected reply from the agent (type %d)", resp[0])
+	}
+	n := binary.BigEndian.Uint32(resp[1:5])
+	rest := resp[5:]
+
+	ids := []identity{}
+	for i := uint32(0); i < n; i++ {
+		var blob, comment []byte
+		blob, rest, err = readString(rest)
+		if err == nil {
+			comment, rest, err = readString(rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("broken SSH_AGENT_IDENTITIES_ANSWER: %s", err)
+		}
+		ids = append(ids, identity{blob: blob, comment: string(comment)})
+	}
+	return ids, nil
+}
+
+// ask the agent to sign the data, and return the signature format and blob
+func signWithAgent(conn io.ReadWriter, id *identity, data []byte) (string, []byte, error) {
+	req := []byte{agentcSignRequest}
+	req = appendString(req, id.blob)
+	req = appendString(req, data)
+	flags := uint32(0)
+	if id.keyType() == "ssh-rsa" {
+		flags = agentRSASHA256
+	}
+	req = appendUint32(req, flags)
+
+	resp, err := agentCall(conn, req)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp[0] != agentSignResponse {
+		return "", nil, fmt.Errorf("unexpected reply from the agent (type %d)", resp[0])
+	}
+	sig, _, err := readString(resp[1:])
+	if err != nil {
+		return "", nil, err
+	}
+	format, sig, err := readString(sig)
+	if err != nil {
+		return "", nil, err
+	}
+	blob, _, err := readString(sig)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(format), blob, nil
+}
+
+// parse the public key blob of ssh-ed25519, ssh-rsa, and ecdsa-sha2-*
+func parsePublicKey(blob []byte) (crypto.PublicKey, error) {
+	keyType, rest, err := readString(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	switch string(keyType) {
+	case "ssh-ed25519":
+		key, _, err := readString(rest)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("broken ssh-ed25519 key")
+		}
+		return ed25519.PublicKey(key), nil
+	case "ssh-rsa":
+		e, rest, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+		n, _, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("too large RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		_, rest, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+		point, _, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+		curve := ecdsaCurve(string(keyType))
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("broken ECDSA key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", keyType)
+}
+
+func ecdsaCurve(keyType string) elliptic.Curve {
+	switch keyType {
+	case "ecdsa-sha2-nistp384":
+		return elliptic.P384()
+	case "ecdsa-sha2-nistp521":
+		return elliptic.P521()
+	}
+	return elliptic.P256()
+}
+
+func verifySignature(pub crypto.PublicKey, format string, data []byte, sig []byte) error {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if format != "ssh-ed25519" || !ed25519.Verify(pub, data, sig) {
+			return errors.New("wrong signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		var hash crypto.Hash
+		var digest []byte
+		switch format {
+		case "rsa-sha2-256":
+			sum := sha256.Sum256(data)
+			hash, digest = crypto.SHA256, sum[:]
+		case "rsa-sha2-512":
+			sum := sha512.Sum512(data)
+			hash, digest = crypto.SHA512, sum[:]
+		default:
+			return fmt.Errorf("unexpected signature format: %s", format)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch pub.Curve {
+		case elliptic.P256():
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		case elliptic.P384():
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		default:
+			sum := sha512.Sum512(data)
+			digest = sum[:]
+		}
+		r, rest, err := readString(sig)
+		if err != nil {
+			return err
+		}
+		s, _, err := readString(rest)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(pub, digest, new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
+			return errors.New("wrong signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+func dialAgent(socketPath string) (net.Conn, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, errNotRunning
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	return conn, nil
+}
+
+// the keys command: list the keys like ssh-add -l
+func runKeys(c *config, w io.Writer) int {
+	conn, err := dialAgent(c.socketPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ids, err := listIdentities(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list the keys: %s\n", err)
+		return 1
+	}
+	if len(ids) == 0 {
+		fmt.Fprintln(w, "The agent has no identities.")
+	}
+	for _, id := range ids {
+		fmt.Fprintln(w, id.describe())
+	}
+	return 0
+}
+
+// the test-sign command: sign a random challenge with each key (or the key of
+// the fingerprint) and verify the signature locally
+func runTestSign(c *config, args []string, w io.Writer) int {
+	conn, err := dialAgent(c.socketPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ids, err := listIdentities(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list the keys: %s\n", err)
+		return 1
+	}
+
+	failures, tested := 0, 0
+	for i := range ids {
+		id := &ids[i]
+		if len(args) > 0 && id.fingerprint() != args[0] && "SHA256:"+args[0] != id.fingerprint() {
+			continue
+		}
+		tested += 1
+
+		err := testSign(conn, id, w)
+		if err != nil {
+			fmt.Fprintf(w, "[FAIL] %s: %s\n", id.describe(), err)
+			failures += 1
+		}
+	}
+
+	if tested == 0 {
+		if len(args) > 0 {
+			fmt.Fprintf(os.Stderr, "no key with the fingerprint: %s\n", args[0])
+		} else {
+			fmt.Fprintln(os.Stderr, "The agent has no identities.")
+		}
+		return 1
+	}
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+func testSign(conn io.ReadWriter, id *identity, w io.Writer) error {
+	pub, err := parsePublicKey(id.blob)
+	if err != nil {
+		return err
+	}
+
+	challenge := make([]byte, 32)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	format, sig, err := signWithAgent(conn, id, challenge)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	err = verifySignature(pub, format, challenge, sig)
+	if err != nil {
+		return fmt.Errorf("%s (%s)", err, format)
+	}
+	fmt.Fprintf(w, "[OK  ] %s: %s signature verified in %v\n", id.describe(), format, elapsed)
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a minimal ssh-agent for tests, which answers REQUEST_IDENTITIES and
+// SIGN_REQUEST with the given keys
+func setupDummyAgent(t *testing.T, keys map[string]crypto.Signer) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	blobs := map[string]crypto.Signer{}
+	answer := []byte{agentIdentitiesAnswer}
+	answer = appendUint32(answer, uint32(len(keys)))
+	for comment, key := range keys {
+		blob := publicKeyBlob(key.Public())
+		blobs[string(blob)] = key
+		answer = appendString(answer, blob)
+		answer = appendString(answer, []byte(comment))
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					req, err := readMessage(conn)
+					if err != nil {
+						return
+					}
+					resp := []byte{agentFailure}
+					switch req[4] {
+					case agentcRequestIdentities:
+						resp = answer
+					case agentcSignRequest:
+						blob, rest, _ := readString(req[5:])
+						data, _, _ := readString(rest)
+						if key, ok := blobs[string(blob)]; ok {
+							resp = appendString([]byte{agentSignResponse}, dummySign(key, data))
+						}
+					}
+					conn.Write(appendString(nil, resp))
+				}
+			}()
+		}
+	}()
+
+	return path
+}
+
+func publicKeyBlob(pub crypto.PublicKey) []byte {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return appendString(appendString(nil, []byte("ssh-ed25519")), pub)
+	case *rsa.PublicKey:
+		blob := appendString(nil, []byte("ssh-rsa"))
+		blob = appendString(blob, big.NewInt(int64(pub.E)).Bytes())
+		return appendString(blob, append([]byte{0}, pub.N.Bytes()...))
+	case *ecdsa.PublicKey:
+		blob := appendString(nil, []byte("ecdsa-sha2-nistp256"))
+		blob = appendString(blob, []byte("nistp256"))
+		return appendString(blob, elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+	}
+	return nil
+}
+
+func dummySign(key crypto.Signer, data []byte) []byte {
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return appendString(appendString(nil, []byte("ssh-ed25519")), ed25519.Sign(key, data))
+	case *rsa.PrivateKey:
+		sum := sha512.Sum512(data)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA512, sum[:])
+		return appendString(appendString(nil, []byte("rsa-sha2-512")), sig)
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		r, s, _ := ecdsa.Sign(rand.Reader, key, sum[:])
+		sig := appendString(appendString(nil, r.Bytes()), s.Bytes())
+		return appendString(appendString(nil, []byte("ecdsa-sha2-nistp256")), sig)
+	}
+	return nil
+}
+
+func dummyKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"ed@host": edKey, "rsa@host": rsaKey, "ec@host": ecKey}
+}
+
+func TestKeys(t *testing.T) {
+	path := setupDummyAgent(t, dummyKeys(t))
+
+	out := &bytes.Buffer{}
+	if runKeys(&config{socketPath: path}, out) != 0 {
+		t.Fatalf("failed: %s", out)
+	}
+	for _, line := range []string{" ed@host (ED25519)", "2048 SHA256:", " rsa@host (RSA)", "256 SHA256:", " ec@host (ECDSA)"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("should show %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestTestSign(t *testing.T) {
+	keys := dummyKeys(t)
+	path := setupDummyAgent(t, keys)
+	c := &config{socketPath: path}
+
+	out := &bytes.Buffer{}
+	if runTestSign(c, nil, out) != 0 {
+		t.Errorf("failed: %s", out)
+	}
+	for _, format := range []string{"ssh-ed25519", "rsa-sha2-512", "ecdsa-sha2-nistp256"} {
+		if !strings.Contains(out.String(), format+" signature verified") {
+			t.Errorf("should verify %s:\n%s", format, out)
+		}
+	}
+
+	id := identity{blob: publicKeyBlob(keys["ed@host"].Public())}
+	out.Reset()
+	if runTestSign(c, []string{id.fingerprint()}, out) != 0 || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("should test the key of the fingerprint: %s", out)
+	}
+
+	if runTestSign(c, []string{"SHA256:none"}, out) == 0 {
+		t.Errorf("should fail for an unknown fingerprint")
+	}
+}
+
+func TestVerifySignatureWrong(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(key, []byte("challenge"))
+	if verifySignature(pub, "ssh-ed25519", []byte("challenge"), sig) != nil {
+		t.Errorf("should be verified")
+	}
+	if verifySignature(pub, "ssh-ed25519", []byte("another"), sig) == nil {
+		t.Errorf("should not be verified")
+	}
+
+	_, _, err = readString([]byte{0, 0, 0, 9, 1})
+	if err == nil {
+		t.Errorf("should detect a truncated string")
+	}
+}
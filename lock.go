@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the lock file serializes the startup: probing the running daemon, removing
+// the stale socket, and listening on the socket; it is never removed, because
+// a process may be waiting for the removed one
+func lockPath(socketPath string) string {
+	return socketPath + ".lock"
+}
+
+func pidPath(socketPath string) string {
+	return socketPath + ".pid"
+}
+
+// the fd of the lock passed to the daemonized child, next to the pipe (fd 3)
+const inheritedLockFd = 4
+
+var lockTimeout = 10 * time.Second
+var lockPollInterval = 50 * time.Millisecond
+
+func acquireLock(path string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %s", path, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// take the lock unless the parent passes it; the daemonized child inherits the
+// lock of the parent, and releases it after listening on the socket
+func (c *config) lockStartup(parent bool) error {
+	if !parent {
+		c.lock = inheritedLock(lockPath(c.socketPath))
+		if c.lock != nil {
+			return nil
+		}
+	}
+
+	// -stop holds the lock while the daemon exits, for twice stopTimeout at worst
+	var err error
+	c.lock, err = acquireLock(lockPath(c.socketPath), lockTimeout+2*c.stopTimeout)
+	if err != nil {
+		return fmt.Errorf("%s; another wsl2-ssh-agent may be starting or stopping", err)
+	}
+	return nil
+}
+
+// the lock held by the parent process, if it is passed to this process
+func inheritedLock(path string) *os.File {
+	var st, fst syscall.Stat_t
+	if syscall.Stat(path, &st) != nil || syscall.Fstat(inheritedLockFd, &fst) != nil {
+		return nil
+	}
+	if st.Dev != fst.Dev || st.Ino != fst.Ino {
+		return nil
+	}
+	// PowerShell must not keep the lock
+	syscall.CloseOnExec(inheritedLockFd)
+	return os.NewFile(inheritedLockFd, path)
+}
+
+// let the next process in; the lock is shared with the parent process, if
+// any, so it must be released explicitly rather than by closing
+func releaseLock(f *os.File) {
+	if f == nil {
+		return
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+func writePidFile(path string) {
+	err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+	if err != nil {
+		log.Printf("failed to write the pid file: %s", err)
+	}
+}
+
+// the pid in the pid file, or -1 if none
+func readPidFile(path string) int {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return -1
+	}
+	return pid
+}
+
+// remove the pid file left by the killed daemon
+func removePidFile(path string, pid int) {
+	if readPidFile(path) == pid {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	lockTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { lockTimeout = 10 * time.Second })
+
+	path := filepath.Join(t.TempDir(), "s.lock")
+	first, err := acquireLock(path, lockTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = acquireLock(path, lockTimeout)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	// released while waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		releaseLock(first)
+	}()
+	lock, err := acquireLock(path, lockTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseLock(lock)
+}
+
+func TestServerLock(t *testing.T) {
+	var pidFile string
+	t.Run("server", func(t *testing.T) {
+		path := setupDummyServer(t, func(c *config) {
+			var err error
+			c.lock, err = acquireLock(lockPath(c.socketPath), lockTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+		pidFile = pidPath(path)
+
+		// released after listening
+		lock, err := acquireLock(lockPath(path), lockTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releaseLock(lock)
+
+		buf, err := os.ReadFile(pidFile)
+		if err != nil || strings.TrimSpace(string(buf)) != strconv.Itoa(os.Getpid()) {
+			t.Errorf("wrong pid file: %q (%v)", buf, err)
+		}
+	})
+
+	_, err := os.Stat(pidFile)
+	if !os.IsNotExist(err) {
+		t.Errorf("the pid file must be removed: %v", err)
+	}
+}
+
+func TestConcurrentStarts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "s")
+
+	// the socket left by a crashed daemon
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	// each start removes the stale socket and listens, slowly; the other
+	// must find it running instead of removing it as stale
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c := &config{socketPath: path}
+			err := c.lockStartup(true)
+			if err != nil {
+				results <- err
+				return
+			}
+			defer releaseLock(c.lock)
+
+			if findRunningServerPid(path) != -1 {
+				results <- nil
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				results <- err
+				return
+			}
+			t.Cleanup(func() { l.Close() })
+			results <- nil
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		err := <-results
+		if err != nil {
+			t.Errorf("failed to start: %v", err)
+		}
+	}
+}
+
+func TestLockStartupTimeout(t *testing.T) {
+	lockTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { lockTimeout = 10 * time.Second })
+
+	path := filepath.Join(t.TempDir(), "s")
+	other, err := acquireLock(lockPath(path), lockTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseLock(other)
+
+	// waits for a -stop, which may take twice stopTimeout
+	c := &config{socketPath: path, stopTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	err = c.lockStartup(true)
+	if err == nil || c.lock != nil {
+		t.Fatalf("should fail without the lock")
+	}
+	if time.Since(start) < lockTimeout+2*c.stopTimeout {
+		t.Errorf("gave up too early: %v", time.Since(start))
+	}
+}
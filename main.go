@@ -1,11 +1,35 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 func main() {
 	c := newConfig()
 
+	switch c.command {
+	case "dump-script":
+		fmt.Print(repeaterPs1)
+		return
+	case "status":
+		os.Exit(runStatus(c, c.args))
+	case "ctl":
+		os.Exit(runCtl(c, c.args))
+	case "keys":
+		os.Exit(runKeys(c, os.Stdout))
+	case "test-sign":
+		os.Exit(runTestSign(c, c.args, os.Stdout))
+	case "exec":
+		os.Exit(runExec(c, c.args))
+	case "doctor":
+		c.setupLogFile()
+		os.Exit(runDoctor(c, os.Stdout))
+	}
+
 	ctx := c.start()
 
-	s := newServer(c.socketPath, c.powershellPath, c.pipeName)
+	s := newServer(c)
 
 	s.run(ctx)
 }
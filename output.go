@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the values of -format except auto
+var outputFormats = []string{"sh", "bash", "zsh", "csh", "tcsh", "fish", "nushell", "elvish", "xonsh", "pwsh", "json", "dotenv"}
+
+// an environment variable to print
+type envVar struct {
+	name  string
+	value string
+}
+
+// guess the format from $SHELL for auto
+func detectOutputFormat(format string) string {
+	if format != "auto" {
+		return format
+	}
+	switch shell := filepath.Base(os.Getenv("SHELL")); {
+	case strings.HasSuffix(shell, "fish"):
+		return "fish"
+	case strings.HasSuffix(shell, "csh"):
+		return "csh"
+	case shell == "nu":
+		return "nushell"
+	case shell == "elvish", shell == "xonsh", shell == "pwsh":
+		return shell
+	}
+	return "sh"
+}
+
+func checkOutputFormat(format string) error {
+	for _, f := range outputFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("output format must be auto, %s", strings.Join(outputFormats, ", "))
+}
+
+// the commands to set the variables in the format
+func formatEnv(format string, vars []envVar) string {
+	if format == "json" {
+		m := map[string]string{}
+		for _, v := range vars {
+			m[v.name] = v.value
+		}
+		buf, _ := json.Marshal(m)
+		return string(buf)
+	}
+
+	lines := []string{}
+	for _, v := range vars {
+		var line string
+		switch format {
+		case "csh", "tcsh":
+			line = fmt.Sprintf("setenv %s %s;", v.name, quoteCsh(v.value))
+		case "fish":
+			line = fmt.Sprintf("set -x %s %s;", v.name, quoteFish(v.value))
+		case "nushell":
+			line = fmt.Sprintf("$env.%s = %s", v.name, quoteNushell(v.value))
+		case "elvish":
+			line = fmt.Sprintf("set-env %s %s", v.name, quoteSingle(v.value, "''"))
+		case "xonsh":
+			line = fmt.Sprintf("$%s = %s", v.name, strconv.Quote(v.value))
+		case "pwsh":
+			line = fmt.Sprintf("$env:%s = %s", v.name, quoteSingle(v.value, "''"))
+		case "dotenv":
+			line = fmt.Sprintf("%s=%s", v.name, quoteDotenv(v.value))
+		default:
+			line = fmt.Sprintf("%s=%s; export %s;", v.name, quoteSh(v.value), v.name)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the commands to unset the variables in the format; dotenv cannot unset, so
+// it just empties them
+func formatUnset(format string, names []string) string {
+	if format == "json" {
+		m := map[string]interface{}{}
+		for _, name := range names {
+			m[name] = nil
+		}
+		buf, _ := json.Marshal(m)
+		return string(buf)
+	}
+
+	lines := []string{}
+	for _, name := range names {
+		var line string
+		switch format {
+		case "csh", "tcsh":
+			line = fmt.Sprintf("unsetenv %s;", name)
+		case "fish":
+			line = fmt.Sprintf("set -e %s;", name)
+		case "nushell":
+			line = fmt.Sprintf("hide-env %s", name)
+		case "elvish":
+			line = fmt.Sprintf("unset-env %s", name)
+		case "xonsh":
+			line = fmt.Sprintf("del $%s", name)
+		case "pwsh":
+			line = fmt.Sprintf("Remove-Item Env:%s", name)
+		case "dotenv":
+			line = fmt.Sprintf("%s=", name)
+		default:
+			line = fmt.Sprintf("unset %s;", name)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the characters that need no quotes in any shell
+func isPlainWord(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("/._-+,:@%", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// a raw string of nushell, r#'...'#, which has no escapes; the hashes are
+// added until the closing sequence does not appear in s
+func quoteNushell(s string) string {
+	hashes := "#"
+	for strings.Contains(s, "'"+hashes) {
+		hashes += "#"
+	}
+	return "r" + hashes + "'" + s + "'" + hashes
+}
+
+// wrap with single quotes, where a single quote is written as escaped
+func quoteSingle(s string, escaped string) string {
+	return "'" + strings.ReplaceAll(s, "'", escaped) + "'"
+}
+
+func quoteSh(s string) string {
+	if isPlainWord(s) {
+		return s
+	}
+	return quoteSingle(s, `'\''`)
+}
+
+// csh expands ! even in single quotes
+func quoteCsh(s string) string {
+	if isPlainWord(s) {
+		return s
+	}
+	return strings.ReplaceAll(quoteSingle(s, `'\''`), "!", `\!`)
+}
+
+// fish allows \\ and \' in single quotes
+func quoteFish(s string) string {
+	if isPlainWord(s) {
+		return s
+	}
+	return quoteSingle(strings.ReplaceAll(s, `\`, `\\`), `\'`)
+}
+
+// systemd's EnvironmentFile takes the rest of the line, or a double-quoted
+// string with backslash escapes; docker --env-file supports only the former
+func quoteDotenv(s string) string {
+	if !strings.ContainsAny(s, "\"'\\\n$`") && strings.TrimSpace(s) == s {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFormatEnv(t *testing.T) {
+	plain := []envVar{{"SSH_AUTH_SOCK", "/home/alice/.ssh/agent.sock"}}
+	tricky := []envVar{{"SSH_AUTH_SOCK", `/tmp/it's a "dir"\!/$x`}}
+
+	cases := []struct {
+		format   string
+		vars     []envVar
+		expected string
+	}{
+		{"bash", plain, "SSH_AUTH_SOCK=/home/alice/.ssh/agent.sock; export SSH_AUTH_SOCK;"},
+		{"bash", tricky, `SSH_AUTH_SOCK='/tmp/it'\''s a "dir"\!/$x'; export SSH_AUTH_SOCK;`},
+		{"csh", plain, "setenv SSH_AUTH_SOCK /home/alice/.ssh/agent.sock;"},
+		{"csh", tricky, `setenv SSH_AUTH_SOCK '/tmp/it'\''s a "dir"\\!/$x';`},
+		{"fish", plain, "set -x SSH_AUTH_SOCK /home/alice/.ssh/agent.sock;"},
+		{"fish", tricky, `set -x SSH_AUTH_SOCK '/tmp/it\'s a "dir"\\!/$x';`},
+		{"nushell", tricky, `$env.SSH_AUTH_SOCK = r#'/tmp/it's a "dir"\!/$x'#`},
+		{"nushell", []envVar{{"SSH_AUTH_SOCK", "/tmp/'#'##/s"}}, `$env.SSH_AUTH_SOCK = r###'/tmp/'#'##/s'###`},
+		{"elvish", tricky, `set-env SSH_AUTH_SOCK '/tmp/it''s a "dir"\!/$x'`},
+		{"xonsh", tricky, `$SSH_AUTH_SOCK = "/tmp/it's a \"dir\"\\!/$x"`},
+		{"pwsh", tricky, `$env:SSH_AUTH_SOCK = '/tmp/it''s a "dir"\!/$x'`},
+		{"json", tricky, `{"SSH_AUTH_SOCK":"/tmp/it's a \"dir\"\\!/$x"}`},
+		{"dotenv", plain, "SSH_AUTH_SOCK=/home/alice/.ssh/agent.sock"},
+		{"dotenv", []envVar{{"SSH_AUTH_SOCK", "/tmp/a dir/s"}}, "SSH_AUTH_SOCK=/tmp/a dir/s"},
+		{"dotenv", tricky, `SSH_AUTH_SOCK="/tmp/it's a \"dir\"\\!/\$x"`},
+		{"bash", append(plain, envVar{"SSH_AGENT_PID", "42"}), "SSH_AUTH_SOCK=/home/alice/.ssh/agent.sock; export SSH_AUTH_SOCK;\nSSH_AGENT_PID=42; export SSH_AGENT_PID;"},
+	}
+	for _, c := range cases {
+		output := formatEnv(c.format, c.vars)
+		if output != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.format, c.expected, output)
+		}
+	}
+}
+
+func TestFormatUnset(t *testing.T) {
+	names := []string{"SSH_AUTH_SOCK", "SSH_AGENT_PID"}
+	cases := map[string]string{
+		"bash":    "unset SSH_AUTH_SOCK;\nunset SSH_AGENT_PID;",
+		"csh":     "unsetenv SSH_AUTH_SOCK;\nunsetenv SSH_AGENT_PID;",
+		"fish":    "set -e SSH_AUTH_SOCK;\nset -e SSH_AGENT_PID;",
+		"nushell": "hide-env SSH_AUTH_SOCK\nhide-env SSH_AGENT_PID",
+		"elvish":  "unset-env SSH_AUTH_SOCK\nunset-env SSH_AGENT_PID",
+		"xonsh":   "del $SSH_AUTH_SOCK\ndel $SSH_AGENT_PID",
+		"pwsh":    "Remove-Item Env:SSH_AUTH_SOCK\nRemove-Item Env:SSH_AGENT_PID",
+		"json":    `{"SSH_AGENT_PID":null,"SSH_AUTH_SOCK":null}`,
+		"dotenv":  "SSH_AUTH_SOCK=\nSSH_AGENT_PID=",
+	}
+	for format, expected := range cases {
+		output := formatUnset(format, names)
+		if output != expected {
+			t.Errorf("%s: expected %s, got %s", format, expected, output)
+		}
+	}
+}
+
+func TestDetectOutputFormat(t *testing.T) {
+	cases := map[string]string{
+		"/bin/bash":           "sh",
+		"/usr/bin/fish":       "fish",
+		"/bin/tcsh":           "csh",
+		"/usr/bin/nu":         "nushell",
+		"/usr/bin/xonsh":      "xonsh",
+		"/opt/microsoft/pwsh": "pwsh",
+	}
+	for shell, expected := range cases {
+		t.Setenv("SHELL", shell)
+		if format := detectOutputFormat("auto"); format != expected {
+			t.Errorf("%s: expected %s, got %s", shell, expected, format)
+		}
+	}
+	if format := detectOutputFormat("json"); format != "json" {
+		t.Errorf("expected json, got %s", format)
+	}
+	if checkOutputFormat("yaml") == nil {
+		t.Errorf("expected an error for yaml")
+	}
+}
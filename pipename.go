@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// named pipes of well-known agents; "{user}" is replaced with the Windows user
+// name, and [W] matches the patterns with Windows wildcards, case-insensitively
+var pipePresets = map[string]string{
+	"openssh":   "openssh-ssh-agent",
+	"pageant":   "pageant.{user}.*",
+	"1password": "openssh-ssh-agent", // 1Password takes over the pipe of OpenSSH
+	"keeagent":  "openssh-ssh-agent", // with "Enable Windows OpenSSH support"
+	"gpg4win":   "openssh-ssh-agent", // with "enable-win32-openssh-support"
+}
+
+// parse the priority order of "-pipename auto"
+func pipeNameOrder(order string) ([]string, error) {
+	presets := []string{}
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := pipePresets[name]; !ok {
+			return nil, fmt.Errorf("unknown pipe name preset: %q (must be openssh, pageant, 1password, keeagent, or gpg4win)", name)
+		}
+		presets = append(presets, name)
+	}
+	return presets, nil
+}
+
+// the patterns that [W] looks for in order, for "auto" or a preset, with the
+// pipe name to try if none is found; nil for other names, which are used as
+// they are, so that [W] does not enumerate the pipes needlessly
+func pipeCandidates(name string, order []string, user string) ([]string, string) {
+	presets := []string{name}
+	if name == "auto" {
+		presets = order
+		if len(presets) == 0 {
+			presets = []string{"openssh"}
+		}
+	}
+
+	candidates := []string{}
+	for _, preset := range presets {
+		pattern, ok := pipePresets[preset]
+		if !ok {
+			return nil, name
+		}
+		candidates = append(candidates, strings.ReplaceAll(pattern, "{user}", user))
+	}
+	return candidates, candidates[0]
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPipeCandidates(t *testing.T) {
+	order := []string{"pageant", "openssh"}
+
+	cases := []struct {
+		name       string
+		order      []string
+		candidates []string
+		fallback   string
+	}{
+		{"my-agent", order, nil, "my-agent"},
+		{"openssh", order, []string{"openssh-ssh-agent"}, "openssh-ssh-agent"},
+		{"1password", order, []string{"openssh-ssh-agent"}, "openssh-ssh-agent"},
+		{"pageant", order, []string{"pageant.alice.*"}, "pageant.alice.*"},
+		{"auto", order, []string{"pageant.alice.*", "openssh-ssh-agent"}, "pageant.alice.*"},
+		{"auto", nil, []string{"openssh-ssh-agent"}, "openssh-ssh-agent"},
+	}
+	for _, c := range cases {
+		candidates, fallback := pipeCandidates(c.name, c.order, "alice")
+		if fmt.Sprint(candidates) != fmt.Sprint(c.candidates) || (candidates == nil) != (c.candidates == nil) || fallback != c.fallback {
+			t.Errorf("%s: expected %v (%s), got %v (%s)", c.name, c.candidates, c.fallback, candidates, fallback)
+		}
+	}
+}
+
+func TestPipeNameOrder(t *testing.T) {
+	order, err := pipeNameOrder("pageant, openssh")
+	if err != nil || len(order) != 2 || order[0] != "pageant" || order[1] != "openssh" {
+		t.Errorf("wrong order: %v (%v)", order, err)
+	}
+
+	_, err = pipeNameOrder("pageant,putty")
+	if err == nil {
+		t.Errorf("should fail")
+	}
+}
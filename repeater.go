@@ -1,107 +1,157 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 )
 
 //go:embed repeater.ps1
 var repeaterPs1 string
 
+// load the repeater script from the file, or the embedded one if the path is
+// empty
+func loadRepeaterScript(path string) (string, error) {
+	if path == "" {
+		return repeaterPs1, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the repeater script: %s", err)
+	}
+	return string(buf), nil
+}
+
 type repeater struct {
-	in  io.WriteCloser
-	out io.Reader
-	cmd *exec.Cmd
+	in          io.WriteCloser
+	out         io.Reader
+	cmd         *exec.Cmd
+	info        repeaterInfo
+	missedPings int
+}
+
+// a message that [W] echoes back without touching the named pipe
+const pingType = 0xf0
+
+var pingMessage = []byte{0, 0, 0, 1, pingType}
+
+// the message types used between [L] and [W], which clients must not send;
+// [W] would answer them by itself, and the reply would be taken for a pong
+func isInternalMessage(req []byte) bool {
+	return len(req) >= 5 && (req[4] == pingType || req[4] == pipeErrorType)
 }
 
+var pingTimeLimit = 3 * time.Second
+
 var waitTimes = []time.Duration{
 	3 * time.Second,
 	6 * time.Second,
 	10 * time.Second,
 }
 
-// invoke PowerShell.exe and run
-func newRepeater(ctx context.Context, powershell string, pipename string) (*repeater, error) {
+// invoke PowerShell.exe and run; the interpreters are tried in the given order
+// so that a broken preferred one falls back to the next
+func newRepeater(ctx context.Context, powershells []string, script string, options repeaterOptions) (*repeater, error) {
 	for i, limit := range waitTimes {
-		log.Printf("invoking [W] in PowerShell.exe%s", trial(i))
+		for _, powershell := range powershells {
+			log.Printf("invoking [W] in %s%s", filepath.Base(powershell), trial(i))
 
-		cmd := exec.Command(powershell, "-Command", "-")
-		in, err := cmd.StdinPipe()
-		if err != nil {
-			continue
-		}
-		out, err := cmd.StdoutPipe()
-		if err != nil {
-			continue
+			rep, err := startRepeater(powershell, script, options, limit)
+			if err == nil {
+				return rep, nil
+			}
+			if errors.Is(err, errIncompatibleScript) {
+				return nil, err
+			}
+			log.Print(err)
 		}
-		cmd.Stderr = logOutput
+	}
 
-		err = cmd.Start()
-		if err != nil {
-			log.Printf("failed to invoke [W]: %s", err)
-			continue
-		}
+	return nil, fmt.Errorf("failed to invoke PowerShell.exe %d times; give up", len(waitTimes))
+}
 
-		// write the source code
-		_, err = io.WriteString(in, repeaterPs1)
-		if err != nil {
-			log.Printf("failed to give [W] the source code: %s", err)
-			terminate(cmd)
-			continue
-		}
+func startRepeater(powershell string, script string, options repeaterOptions, limit time.Duration) (*repeater, error) {
+	cmd := exec.Command(powershell, "-Command", "-")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke [W]: %s", err)
+	}
+	go relayWLog(stderr)
 
-		done := make(chan bool)
-
-		// wait for the process start up
-		go func() {
-			// the process should output "\xff" if it starts successfully
-			// ignore any output until we got "\xff"
-			buf := make([]byte, 1)
-			for {
-				n, err := out.Read(buf)
-				if err != nil {
-					done <- false
-					return
-				}
-				if n == 1 && buf[0] == 0xff {
-					done <- true
-					return
-				}
+	// write the source code
+	_, err = io.WriteString(in, script)
+	if err != nil {
+		terminate(cmd)
+		return nil, fmt.Errorf("failed to give [W] the source code: %s", err)
+	}
+
+	done := make(chan bool)
+
+	// wait for the process start up
+	go func() {
+		// the process should output "\xff" if it starts successfully
+		// ignore any output until we got "\xff"
+		buf := make([]byte, 1)
+		for {
+			n, err := out.Read(buf)
+			if err != nil {
+				done <- false
+				return
 			}
-		}()
-
-		select {
-		case ok := <-done:
-			if ok {
-				log.Printf("[W] invoked successfully")
-
-				buf := make([]byte, 4)
-				buf[0] = byte((len(pipename) >> 24) & 0xff)
-				buf[1] = byte((len(pipename) >> 16) & 0xff)
-				buf[2] = byte((len(pipename) >> 8) & 0xff)
-				buf[3] = byte(len(pipename) & 0xff)
-				_, err = io.WriteString(in, string(buf)+pipename)
-				if err != nil {
-					log.Printf("failed to give [W] the pipe name: %s", err)
-					terminate(cmd)
-					continue
-				}
-
-				return &repeater{in, out, cmd}, nil
+			if n == 1 && buf[0] == 0xff {
+				done <- true
+				return
 			}
-		case <-time.After(limit):
 		}
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			log.Printf("[W] invoked successfully in %s", powershell)
+
+			rep := &repeater{in: in, out: out, cmd: cmd}
+			err = rep.handshake(options, limit)
+			if err != nil {
+				terminate(cmd)
+				return nil, err
+			}
+			log.Printf("[W] PowerShell %s (%s), ssh-agent.exe %s, named pipe %s (%s)",
+				rep.info.PSVersion, rep.info.PSEdition, rep.info.SSHAgentVersion, rep.info.PipeName, rep.info.Pipe)
+			if rep.info.Pipe != "ok" {
+				log.Print((&pipeError{Code: rep.info.Pipe}).advice(rep.info.PipeName))
+			}
 
-		log.Printf("PowerShell.exe does not respond in %v", limit)
+			return rep, nil
+		}
 		terminate(cmd)
+		return nil, fmt.Errorf("%s exited before [W] started", filepath.Base(powershell))
+	case <-time.After(limit):
 	}
 
-	return nil, fmt.Errorf("failed to invoke PowerShell.exe %d times; give up", len(waitTimes))
+	terminate(cmd)
+	return nil, fmt.Errorf("%s does not respond in %v", filepath.Base(powershell), limit)
 }
 
 func terminate(cmd *exec.Cmd) {
@@ -112,6 +162,55 @@ func terminate(cmd *exec.Cmd) {
 	cmd.Wait() //nolint:errcheck
 }
 
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+func (rep *repeater) setReadDeadline(t time.Time) {
+	if out, ok := rep.out.(deadliner); ok {
+		err := out.SetReadDeadline(t)
+		if err != nil {
+			log.Printf("failed to set timeout: %s", err)
+		}
+	}
+}
+
+// read a reply to a request; a pong that arrives after its ping timed out is
+// skipped
+func (rep *repeater) readReply() ([]byte, error) {
+	for {
+		resp, err := readMessage(rep.out)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(resp, pingMessage) {
+			return resp, nil
+		}
+	}
+}
+
+// send a ping to [W] and wait for the pong
+func (rep *repeater) ping() (time.Duration, error) {
+	start := time.Now()
+	_, err := rep.in.Write(pingMessage)
+	if err != nil {
+		return 0, err
+	}
+
+	rep.setReadDeadline(start.Add(pingTimeLimit))
+	defer rep.setReadDeadline(time.Time{})
+
+	for {
+		resp, err := readMessage(rep.out)
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(resp, pingMessage) {
+			return time.Since(start), nil
+		}
+	}
+}
+
 func (rep *repeater) terminate() {
 	rep.in.Close()
 	terminate(rep.cmd)
@@ -1,3 +1,7 @@
+# the version of the protocol between [L] and [W]; it must match the one of
+# wsl2-ssh-agent
+$ProtocolVersion = 3
+
 Function Log($msg) {
 	$date = Get-Date -Format "yyyy/MM/dd HH:mm:ss"
 	$host.ui.WriteErrorLine("[W] $date $msg")
@@ -28,6 +32,95 @@ Function ReadMessage($stream) {
 	return $buf
 }
 
+Function WriteMessage($stream, [byte[]]$body) {
+	$len = $body.Length
+	$header = [byte[]]((($len -shr 24) -band 0xff), (($len -shr 16) -band 0xff), (($len -shr 8) -band 0xff), ($len -band 0xff))
+	$buf = [byte[]]($header + $body)
+	$stream.Write($buf, 0, $buf.Length)
+}
+
+Function WriteJsonMessage($stream, $obj) {
+	WriteMessage $stream ([System.Text.Encoding]::UTF8.GetBytes(($obj | ConvertTo-Json -Compress)))
+}
+
+# tell [L] why the request could not be relayed: 0xf1 followed by {error, message}
+Function WritePipeError($stream, $code, $message) {
+	$json = [System.Text.Encoding]::UTF8.GetBytes((@{ error = $code; message = $message } | ConvertTo-Json -Compress))
+	WriteMessage $stream ([byte[]](0xf1) + $json)
+	Log "[W] named pipe: $code ($message)"
+}
+
+Function ReadJsonMessage($stream) {
+	$buf = ReadMessage $stream
+	return [System.Text.Encoding]::UTF8.GetString($buf, 4, $buf.Length - 4) | ConvertFrom-Json
+}
+
+# the pipes whose names match the pattern; the system filters them, because
+# enumerating all pipes throws on a name that is not a valid path
+Function ListPipes($pattern) {
+	Try {
+		return [string[]]([System.IO.Directory]::GetFiles("\\.\pipe\", $pattern) | ForEach-Object { $_.Substring(9) })
+	}
+	Catch {
+		Log "[W] failed to list the pipes ($pattern): $($_.Exception.Message)"
+		return @()
+	}
+}
+
+Function TestPipe($pipename) {
+	if (@(ListPipes $pipename) -contains $pipename) {
+		return "ok"
+	}
+	return "missing"
+}
+
+# the first pipe that matches the patterns in order, or $null
+Function FindPipe($patterns) {
+	foreach ($pattern in $patterns) {
+		$pipes = @(ListPipes $pattern)
+		if ($pipes.Length -gt 0) {
+			return $pipes[0]
+		}
+	}
+	return $null
+}
+
+# returns a connected stream, or an error code (missing, denied, busy, timeout, error) with a message
+Function ConnectPipe($pipename, $timeout) {
+	$deadline = [DateTime]::Now.AddMilliseconds($timeout)
+	while ($true) {
+		$pipe = New-Object System.IO.Pipes.NamedPipeClientStream ".", $pipename, InOut
+		$remaining = [Math]::Max([int]($deadline - [DateTime]::Now).TotalMilliseconds, 0)
+		Try {
+			$pipe.Connect($remaining)
+			return $pipe
+		}
+		Catch [System.TimeoutException] {
+			$pipe.Dispose()
+			if ((TestPipe $pipename) -eq "missing") {
+				return "missing", "\\.\pipe\$pipename does not exist"
+			}
+			return "busy", "all instances of \\.\pipe\$pipename are busy"
+		}
+		Catch [System.UnauthorizedAccessException] {
+			$pipe.Dispose()
+			return "denied", $_.Exception.Message
+		}
+		Catch [System.IO.IOException] {
+			$pipe.Dispose()
+			# ERROR_PIPE_BUSY: another client took the instance; wait for the next one
+			if ((($_.Exception.HResult -band 0xffff) -eq 231) -and ([DateTime]::Now -lt $deadline)) {
+				Start-Sleep -Milliseconds 50
+				Continue
+			}
+			if (($_.Exception.HResult -band 0xffff) -eq 231) {
+				return "busy", $_.Exception.Message
+			}
+			return "error", $_.Exception.Message
+		}
+	}
+}
+
 Function MainLoop {
 	Try {
 		$ignoreOpenSSHExtensions = $false
@@ -39,30 +132,62 @@ Function MainLoop {
 		Catch {
 			$ignoreOpenSSHExtensions = $true
 		}
+		$sshAgentService = (Get-Service ssh-agent -ErrorAction SilentlyContinue).Status
 
 		$ssh_client_in = [console]::OpenStandardInput()
 		$ssh_client_out = [console]::OpenStandardOutput()
 
+		# handshake: "\xff", hello ([W] -> [L]), options ([L] -> [W]), and ready ([W] -> [L])
 		$ver = $PSVersionTable["PSVersion"]
+		$edition = $PSVersionTable["PSEdition"]
+		$hello = @{
+			protocol = $ProtocolVersion
+			psVersion = "$ver"
+			psEdition = "$edition"
+			sshAgentVersion = "$sshAgentVersion"
+			sshAgentService = "$sshAgentService"
+			ignoreOpenSSHExtensions = $ignoreOpenSSHExtensions
+			user = "$env:USERNAME"
+		}
+		# the hello must follow "\xff" immediately; [L] waits for it only for a limited time
 		$ssh_client_out.WriteByte(0xff)
-		Log "ready: PSVersion $ver"
+		WriteJsonMessage $ssh_client_out $hello
+		Log "ready: PSVersion $ver ($edition)"
 
-		$buf = ReadMessage $ssh_client_in
-		$pipename = [System.Text.Encoding]::UTF8.GetString($buf[4..$buf.Length])
-		Log "[W] named pipe: $pipename"
+		$options = ReadJsonMessage $ssh_client_in
+		$pipename = $options.pipeName
+		$pipeTimeout = $options.pipeTimeout
+		if ($null -ne $options.pipeCandidates) {
+			$found = FindPipe $options.pipeCandidates
+			if ($null -ne $found) {
+				$pipename = $found
+			}
+		}
+		$pipe = TestPipe $pipename
+		WriteJsonMessage $ssh_client_out @{ pipeName = $pipename; pipe = $pipe }
+		Log "[W] named pipe: $pipename ($pipe)"
 
 		while ($true) {
 			Try {
 				$null = $ssh_client_in.Read((New-Object byte[] 1), 0, 0)
 				$buf = ReadMessage $ssh_client_in
+				if ($buf.Length -eq 5 -and $buf[4] -eq 0xf0) {
+					# heartbeat from [L]
+					$ssh_client_out.Write($buf, 0, $buf.Length)
+					Continue
+				}
 				if ($ignoreOpenSSHExtensions -and $buf.Length -gt 4 -and $buf[4] -eq 0x1b) {
 					$buf = [byte[]](0, 0, 0, 1, 6)
 					$ssh_client_out.Write($buf, 0, $buf.Length)
 					Log "[W] return dummy for OpenSSH ext."
 					Continue
 				}
-				$ssh_agent = New-Object System.IO.Pipes.NamedPipeClientStream ".", $pipename, InOut
-				$ssh_agent.Connect()
+				$ssh_agent = ConnectPipe $pipename $pipeTimeout
+				if ($ssh_agent -isnot [System.IO.Pipes.NamedPipeClientStream]) {
+					WritePipeError $ssh_client_out $ssh_agent[0] $ssh_agent[1]
+					$ssh_agent = $null
+					Continue
+				}
 				Log "[W] named pipe: connected"
 				$ssh_agent.Write($buf, 0, $buf.Length)
 				Log "[L] -> [W] -> ssh-agent.exe ($($buf.Length) B)"
@@ -73,13 +198,14 @@ Function MainLoop {
 			Finally {
 				if ($null -ne $ssh_agent) {
 					$ssh_agent.Dispose()
+					$ssh_agent = $null
 					Log "[W] named pipe: disconnected"
 				}
 			}
 		}
 	}
 	Finally {
-		$host.ui.WriteErrorLine("wsl2-ssh-agent.ps1: terminated")
+		Log "terminated"
 	}
 }
 
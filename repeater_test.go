@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -14,10 +16,29 @@ const dummyBrokenPowerShell = `#!/usr/bin/ruby
 $stdin.read
 `
 
-const dummyEchoPowerShell = `#!/usr/bin/ruby
+// the ruby code of the handshake of dummy [W]; it stores the source code of
+// repeater.ps1 in $script, and the options from [L] in $options
+func dummyHandshake(protocol int) string {
+	return fmt.Sprintf(`require "json"
+$script = $stdin.read(%d)
+hello = { protocol: %d, psVersion: "7.4.0", psEdition: "Core", sshAgentVersion: "9.5.4.1", sshAgentService: "Running", ignoreOpenSSHExtensions: false, user: "alice" }.to_json
+$stdout << "\xff" << [hello.bytesize].pack("N") << hello
+len = $stdin.read(4)
+$options = JSON.parse($stdin.read(len.unpack1("N")))
+pipes = ["pageant.alice.0123abcd", "openssh-ssh-agent"]
+found = ($options["pipeCandidates"] || []).map { |pat| pipes.find { |pipe| File.fnmatch(pat, pipe, File::FNM_CASEFOLD) } }.compact.first
+$options["pipeName"] = found if found
+ready = { pipeName: $options["pipeName"], pipe: "ok" }.to_json
+$stdout << [ready.bytesize].pack("N") << ready
+`, len(repeaterPs1), protocol)
+}
+
+var dummyEchoPowerShell = `#!/usr/bin/ruby
 $stdout.sync = true
 $stdout << "Warning: Some dummy ramdom warming messages ... Dummy ...\n"
-$stdout << "\xff"
+` + dummyHandshake(protocolVersion) + `
+$stdout << $script
+$stdout << [$options["pipeName"].bytesize].pack("N") << $options["pipeName"]
 loop do
   $stdout << $stdin.getc
 end
@@ -37,10 +58,45 @@ func setupDummyEnv(t *testing.T) string {
 	return tmpDir
 }
 
+func lookupPowerShells(t *testing.T, order string) []string {
+	t.Helper()
+	paths, err := powershellPaths(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestPowerShellPaths(t *testing.T) {
+	tmpDir := setupDummyEnv(t)
+
+	paths := lookupPowerShells(t, "pwsh,powershell")
+	if len(paths) != 0 {
+		t.Errorf("should find nothing: %v", paths)
+	}
+
+	for _, name := range []string{"pwsh.exe", "powershell.exe"} {
+		err := os.WriteFile(filepath.Join(tmpDir, name), []byte(dummyBrokenPowerShell), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths = lookupPowerShells(t, "powershell, pwsh")
+	if len(paths) != 2 || paths[0] != filepath.Join(tmpDir, "powershell.exe") || paths[1] != filepath.Join(tmpDir, "pwsh.exe") {
+		t.Errorf("wrong order: %v", paths)
+	}
+
+	_, err := powershellPaths("pwsh,cmd")
+	if err == nil {
+		t.Errorf("should fail")
+	}
+}
+
 func TestRepeaterNoPowerShell(t *testing.T) {
 	setupDummyEnv(t)
 
-	_, err := newRepeater(context.Background(), "/dummy/powershell.exe", "dummy-pipe-name")
+	_, err := newRepeater(context.Background(), []string{"/dummy/powershell.exe"}, repeaterPs1, repeaterOptions{PipeName: "dummy-pipe-name"})
 	if err == nil || err.Error() != "failed to invoke PowerShell.exe 3 times; give up" {
 		t.Errorf("should fail")
 	}
@@ -53,7 +109,7 @@ func TestRepeaterBrokenPowerShell(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = newRepeater(context.Background(), powershellPath(), "dummy-pipe-name")
+	_, err = newRepeater(context.Background(), lookupPowerShells(t, "powershell"), repeaterPs1, repeaterOptions{PipeName: "dummy-pipe-name"})
 	if err == nil || err.Error() != "failed to invoke PowerShell.exe 3 times; give up" {
 		t.Errorf("should fail")
 	}
@@ -67,9 +123,13 @@ func TestRepeaterNormal(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rep, err := newRepeater(context.Background(), powershellPath(), "dummy-pipe-name")
+	rep, err := newRepeater(context.Background(), lookupPowerShells(t, "powershell"), repeaterPs1, repeaterOptions{PipeName: "dummy-pipe-name"})
 	if err != nil {
-		t.Errorf("failed: %s", err)
+		t.Fatalf("failed: %s", err)
+	}
+
+	if rep.info.PSVersion != "7.4.0" || rep.info.SSHAgentVersion != "9.5.4.1" || rep.info.PipeName != "dummy-pipe-name" || rep.info.Pipe != "ok" {
+		t.Errorf("wrong handshake: %+v", rep.info)
 	}
 
 	buf := make([]byte, len(repeaterPs1))
@@ -96,3 +156,115 @@ func TestRepeaterNormal(t *testing.T) {
 
 	rep.terminate()
 }
+
+func TestRepeaterPipeNameAuto(t *testing.T) {
+	tmpDir := setupDummyEnv(t)
+
+	err := os.WriteFile(filepath.Join(tmpDir, "powershell.exe"), []byte(dummyEchoPowerShell), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := newRepeater(context.Background(), lookupPowerShells(t, "powershell"), repeaterPs1, repeaterOptions{PipeName: "auto", pipeOrder: []string{"pageant", "openssh"}})
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	defer rep.terminate()
+
+	if rep.info.PipeName != "pageant.alice.0123abcd" {
+		t.Errorf("should find the pipe of pageant: %s", rep.info.PipeName)
+	}
+
+	// fail fast rather than hang if [W] receives a shorter name
+	rep.setReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, len(repeaterPs1)+4+22)
+	_, err = io.ReadFull(rep.out, buf)
+	if err != nil || string(buf[len(repeaterPs1)+4:]) != "pageant.alice.0123abcd" {
+		t.Errorf("[W] should receive the resolved pipe name: %s", string(buf[len(repeaterPs1):]))
+	}
+}
+
+func TestRepeaterFallback(t *testing.T) {
+	tmpDir := setupDummyEnv(t)
+
+	err := os.WriteFile(filepath.Join(tmpDir, "pwsh.exe"), []byte(dummyBrokenPowerShell), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(tmpDir, "powershell.exe"), []byte(dummyEchoPowerShell), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := newRepeater(context.Background(), lookupPowerShells(t, "pwsh,powershell"), repeaterPs1, repeaterOptions{PipeName: "dummy-pipe-name"})
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	defer rep.terminate()
+
+	if filepath.Base(rep.cmd.Path) != "powershell.exe" {
+		t.Errorf("should fall back to powershell.exe: %s", rep.cmd.Path)
+	}
+}
+
+func TestRepeaterIncompatible(t *testing.T) {
+	tmpDir := setupDummyEnv(t)
+
+	dummyOldPowerShell := "#!/usr/bin/ruby\n$stdout.sync = true\n" + dummyHandshake(1) + "sleep\n"
+	err := os.WriteFile(filepath.Join(tmpDir, "powershell.exe"), []byte(dummyOldPowerShell), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newRepeater(context.Background(), lookupPowerShells(t, "powershell"), repeaterPs1, repeaterOptions{PipeName: "dummy-pipe-name"})
+	if !errors.Is(err, errIncompatibleScript) {
+		t.Errorf("should fail with incompatible script: %v", err)
+	}
+}
+
+func TestRepeaterNoHello(t *testing.T) {
+	for name, afterReady := range map[string]string{
+		// the script of the first version waits for the pipe name
+		"protocol 1": "len = $stdin.read(4)\nsleep\n",
+		// a garbage length must not be allocated
+		"garbage": "$stdout << \"\\xff\\xff\\xff\\xff\"\nsleep\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := setupDummyEnv(t)
+
+			dummy := fmt.Sprintf("#!/usr/bin/ruby\n$stdout.sync = true\n$script = $stdin.read(%d)\n$stdout << \"\\xff\"\n", len(repeaterPs1)) + afterReady
+			err := os.WriteFile(filepath.Join(tmpDir, "powershell.exe"), []byte(dummy), 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// retried through the breaker, not refused as incompatible
+			_, err = newRepeater(context.Background(), lookupPowerShells(t, "powershell"), repeaterPs1, repeaterOptions{PipeName: "dummy-pipe-name"})
+			if err == nil || errors.Is(err, errIncompatibleScript) {
+				t.Errorf("should fail after the retries: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadRepeaterScript(t *testing.T) {
+	script, err := loadRepeaterScript("")
+	if err != nil || script != repeaterPs1 {
+		t.Errorf("should be the embedded script")
+	}
+
+	path := filepath.Join(t.TempDir(), "custom.ps1")
+	err = os.WriteFile(path, []byte("Write-Host custom"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err = loadRepeaterScript(path)
+	if err != nil || script != "Write-Host custom" {
+		t.Errorf("should be the custom script: %q", script)
+	}
+
+	_, err = loadRepeaterScript(filepath.Join(t.TempDir(), "missing.ps1"))
+	if err == nil {
+		t.Errorf("should fail")
+	}
+}
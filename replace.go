@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"syscall"
+)
+
+// the options that do not affect the daemon
+var clientOnlyFlags = map[string]bool{
+	"foreground":   true,
+	"format":       true,
+	"stop":         true,
+	"stop-timeout": true,
+	"k":            true,
+	"version":      true,
+	"replace":      true,
+	"config":       true, // the values in it are compared instead
+}
+
+// the effective options of the daemon, compared with the running one
+func (c *config) settings() map[string]string {
+	settings := map[string]string{}
+	flags := c.flags
+	if flags == nil {
+		flags = flag.CommandLine
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		if !clientOnlyFlags[f.Name] {
+			settings[f.Name] = f.Value.String()
+		}
+	})
+	settings["socket"] = c.socketPath
+	settings["control-socket"] = c.controlPath
+	return settings
+}
+
+// the options different from the running daemon's, like "-pipename: a (running), b (requested)"
+func (c *config) differences() ([]string, error) {
+	running := map[string]string{}
+	err := controlCall(c.controlPath, controlRequest{Command: "config"}, &running)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []string{}
+	for name, value := range c.settings() {
+		if running[name] != value {
+			diffs = append(diffs, fmt.Sprintf("-%s: %q (running), %q (requested)", name, running[name], value))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// decide whether to replace the running daemon; the daemonized child just
+// follows the decision of the parent, which passes -replace
+func (c *config) shouldReplace(serverPid int, parent bool) bool {
+	if !parent {
+		return c.replace
+	}
+	if c.command == "restart" {
+		return true
+	}
+
+	diffs, err := c.differences()
+	if errors.Is(err, errNotRunning) {
+		// systemd listens on the socket, and starts the daemon on demand
+		return false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to get the options of wsl2-ssh-agent (pid: %d): %s\n", serverPid, err)
+		return c.replace
+	}
+	if len(diffs) == 0 {
+		return false
+	}
+	if c.replace {
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "warning: wsl2-ssh-agent (pid: %d) is running with different options:\n", serverPid)
+	for _, diff := range diffs {
+		fmt.Fprintf(os.Stderr, "  %s\n", diff)
+	}
+	fmt.Fprintf(os.Stderr, "use -replace to restart it with the new options\n")
+	return false
+}
+
+// listen on the socket of the running daemon without a moment of absence: bind
+// a temporary socket, rename it to the path, and then ask the old daemon to
+// exit without removing the path
+func takeOver(c *config) (net.Listener, error) {
+	err := controlCall(c.controlPath, controlRequest{Command: "config"}, nil)
+	if err != nil {
+		// too old to hand over; just stop it
+		if !c.isDaemonProcess(c.replacePid) {
+			return nil, fmt.Errorf("%s is used by another program (pid: %d), not wsl2-ssh-agent", c.socketPath, c.replacePid)
+		}
+		log.Printf("failed to ask wsl2-ssh-agent (pid: %d) to hand over: %s; stop it", c.replacePid, err)
+		err = stopService(c, c.replacePid)
+		if err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", c.socketPath)
+	}
+
+	tmpPath := fmt.Sprintf("%s.%d", c.socketPath, os.Getpid())
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Rename(tmpPath, c.socketPath)
+	if err != nil {
+		listener.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to replace %s: %s", c.socketPath, err)
+	}
+
+	err = controlCall(c.controlPath, controlRequest{Command: "handover"}, nil)
+	if err != nil {
+		// the new socket is in place anyway; kill the old one so that it
+		// cannot remove the socket, unless the pid is not of wsl2-ssh-agent
+		if c.isDaemonProcess(c.replacePid) {
+			log.Printf("failed to hand over from wsl2-ssh-agent (pid: %d): %s; kill it", c.replacePid, err)
+			syscall.Kill(c.replacePid, syscall.SIGKILL)
+		} else {
+			log.Printf("failed to hand over from wsl2-ssh-agent: %s; pid %d is not wsl2-ssh-agent, so leave it", err, c.replacePid)
+		}
+	}
+
+	log.Printf("took over %s from wsl2-ssh-agent (pid: %d)", c.socketPath, c.replacePid)
+	return listener, nil
+}
+
+// remove the sockets and the pid file unless they are handed over to a new
+// daemon
+func (s *server) removeSockets() {
+	if atomic.LoadInt32(&s.handedOver) == 1 {
+		return
+	}
+	for _, path := range s.ownedFiles {
+		os.Remove(path)
+	}
+}
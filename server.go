@@ -3,28 +3,191 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type server struct {
-	listener       net.Listener
-	powershellPath string
-	pipeName       string
+	listener        net.Listener
+	control         net.Listener
+	activated       bool // the socket is passed by systemd socket activation
+	reloadLock      sync.Mutex // for the fields below that reload-config changes
+	powershellPaths []string
+	scriptPath      string
+	script          string
+	options         repeaterOptions
+	settings        map[string]string
+	reread          func() (*config, error)
+	standby         bool
+	standbyIdle     time.Duration
+	standbyQueue    chan *repeater
+	standbyWanted   chan struct{}
+	heartbeat       time.Duration
+	heartbeatMisses int
+	health          health
+	breaker         *breaker
+	recovering      sync.WaitGroup
+	lazy            bool
+	idleTimeout     time.Duration
+	wakeup          chan struct{}
+	cancel          func()
+	tasks           chan loopTask
+	socketPath      string
+	controlPath     string
+	handedOver      int32
+	starting        int32 // the server loop is invoking PowerShell, which has its own time limits
+	ownedFiles      []string
+	notifier        *notifier
+	startedAt       time.Time
+	clients         clients
 }
 
-func newServer(socketPath string, powershellPath string, pipeName string) *server {
-	listener, err := net.Listen("unix", socketPath)
-	if err != nil {
-		log.Fatal(err)
+// a function that the server loop runs with the current repeater, e.g., to
+// restart it on the request from the control socket
+type loopTask struct {
+	run  func(rep *repeater) *repeater
+	done chan struct{}
+}
+
+// what the active repeater reported, the result of the latest heartbeat, and
+// what happened so far; reported by the status command
+type health struct {
+	sync.Mutex
+	info        repeaterInfo
+	pingAt      time.Time
+	pingRTT     time.Duration
+	state       string // running, stopped, or down
+	transport   string
+	breaker     breakerState
+	starts      int
+	lastError   string
+	lastErrorAt time.Time
+	stats       stats
+}
+
+// the counters reported by the stats command
+type stats struct {
+	Connections int64 `json:"connections"`
+	Requests    int64 `json:"requests"`
+	Failures    int64 `json:"failures"`
+	PipeErrors  int64 `json:"pipeErrors"`
+	BytesIn     int64 `json:"bytesIn"`
+	BytesOut    int64 `json:"bytesOut"`
+	Pings       int64 `json:"pings"`
+	MissedPings int64 `json:"missedPings"`
+}
+
+// the ssh clients connected to the agent socket
+type clients struct {
+	sync.Mutex
+	nextID int
+	m      map[int]*clientInfo
+}
+
+func newServer(c *config) *server {
+	// the sockets passed by systemd belong to systemd; the others and the pid
+	// file are removed on exit
+	owned := []string{}
+
+	listener := c.listener
+	var err error
+	if listener == nil {
+		if c.replacePid > 0 {
+			listener, err = takeOver(c)
+		} else {
+			listener, err = net.Listen("unix", c.socketPath)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		owned = append(owned, c.socketPath)
+	}
+	log.Printf("start listening on %s", c.socketPath)
+
+	control := c.controlListener
+	if control == nil {
+		control, err = listenControl(c.controlPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		owned = append(owned, c.controlPath)
+	}
+	log.Printf("control socket: %s", c.controlPath)
+
+	// the sockets are removed by removeSockets unless handed over
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	control.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	// now the other processes find this daemon
+	writePidFile(pidPath(c.socketPath))
+	owned = append(owned, pidPath(c.socketPath))
+	releaseLock(c.lock)
+	c.lock = nil
+
+	logScript(c.repeaterScript, c.script)
+
+	return &server{
+		listener:        listener,
+		control:         control,
+		activated:       c.listener != nil,
+		powershellPaths: c.powershellPaths,
+		scriptPath:      c.repeaterScript,
+		script:          c.script,
+		options:         c.options(),
+		standby:         c.standby,
+		standbyIdle:     c.standbyIdle,
+		standbyQueue:    make(chan *repeater, 1),
+		standbyWanted:   make(chan struct{}, 1),
+		heartbeat:       c.heartbeat,
+		heartbeatMisses: c.heartbeatMisses,
+		breaker:         newBreaker(c.retry),
+		lazy:            c.lazy,
+		idleTimeout:     c.idleTimeout,
+		wakeup:          make(chan struct{}, 1),
+		tasks:           make(chan loopTask),
+		socketPath:      c.socketPath,
+		controlPath:     c.controlPath,
+		settings:        c.settings(),
+		reread:          c.reread,
+		ownedFiles:      owned,
+		notifier:        newNotifier(),
+		startedAt:       time.Now(),
+		clients:         clients{m: map[int]*clientInfo{}},
+	}
+}
+
+func logScript(path, script string) {
+	source := path
+	if source == "" {
+		source = "embedded"
 	}
-	log.Printf("start listening on %s", socketPath)
+	log.Printf("repeater script: %s (sha256: %x)", source, sha256.Sum256([]byte(script)))
+}
+
+// how to invoke a new repeater; reload-config may change them
+func (s *server) repeaterSettings() ([]string, string, repeaterOptions) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	return s.powershellPaths, s.script, s.options
+}
 
-	return &server{listener, powershellPath, pipeName}
+func (s *server) currentSettings() map[string]string {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	settings := map[string]string{}
+	for name, value := range s.settings {
+		settings[name] = value
+	}
+	return settings
 }
 
 type request struct {
@@ -35,11 +198,45 @@ type response []byte
 
 func (s *server) run(ctx context.Context) {
 	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctx.Done()
 		log.Println("shutdown")
+		s.notifier.notify("STOPPING=1")
 		s.listener.Close()
+		s.control.Close()
+		s.removeSockets()
+	}()
+
+	// invoke goroutine for the control socket
+	controlDone := make(chan struct{})
+	go func() {
+		defer close(controlDone)
+		s.serveControl(ctx)
+	}()
+
+	// the clients can connect now; PowerShell is invoked in the server loop
+	s.notifier.notify(fmt.Sprintf("READY=1\nSTATUS=listening on %s", s.socketPath))
+
+	// invoke goroutine for the watchdog of systemd
+	watchdogDone := make(chan struct{})
+	go func() {
+		defer close(watchdogDone)
+		if s.notifier != nil && s.notifier.watchdog > 0 {
+			s.watchdog(ctx)
+		}
+	}()
+
+	// invoke goroutine for the standby PowerShell.exe
+	standbyDone := make(chan struct{})
+	go func() {
+		defer close(standbyDone)
+		if s.standby {
+			s.keepStandby(ctx)
+		}
 	}()
 
 	// invoke gorountine for ssh-agent.exe
@@ -61,6 +258,8 @@ func (s *server) run(ctx context.Context) {
 
 		// invoke goroutine for ssh client
 		log.Printf("ssh: connected")
+		s.count(func(st *stats) { st.Connections += 1 })
+		s.wake()
 		wg.Add(1)
 		go s.client(wg, ctx, sshClient, requestQueue)
 	}
@@ -71,96 +270,459 @@ func (s *server) run(ctx context.Context) {
 	// wait for ssh-agent.exe to exit
 	close(requestQueue)
 	<-done
+	<-standbyDone
+	<-controlDone
+	<-watchdogDone
+	<-shutdownDone
+	s.recovering.Wait()
 }
 
 func (s *server) server(ctx context.Context, cancel func(), requestQueue chan request, done chan struct{}) {
 	defer close(done)
 
-	var pendingRequest *request
-	retryCount := 0
+	// the repeater serving requests; nil while PowerShell.exe is down
+	var rep *repeater
+
+	// a recovery attempt in background while the breaker is open
+	var recovery <-chan time.Time
+	recovered := make(chan *repeater)
 
 	defer func() {
 		// abort all pending requests
 		cancel()
-		if pendingRequest != nil {
-			close(pendingRequest.resultChannel)
+		if rep != nil {
+			rep.terminate()
 		}
 		for req := range requestQueue {
 			close(req.resultChannel)
 		}
 	}()
 
+	// invoke PowerShell.exe unless it is deferred until the first client
+	if !s.lazy {
+		rep = s.connect(ctx)
+	}
+	lastRequest := time.Now()
+	lastPing := time.Now()
+
 	for {
-		// invoke PowerShell.exe
-		rep, err := newRepeater(ctx, s.powershellPath, s.pipeName)
-		if err != nil {
+		s.updateHealth(rep)
+		prev := rep
+
+		if s.breaker.state == breakerOpen && recovery == nil {
+			delay := s.breaker.backoff()
+			log.Printf("[W] is down; retry in %v", delay.Round(time.Millisecond))
+			recovery = time.After(delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[W] terminated")
 			return
+		case req, ok := <-requestQueue:
+			if !ok {
+				return
+			}
+			rep = s.serve(ctx, rep, &req)
+			if rep != nil && s.standby {
+				s.wantStandby()
+			}
+			lastRequest = time.Now()
+		case task := <-s.tasks:
+			rep = task.run(rep)
+			close(task.done)
+		case <-s.wakeup:
+			if rep == nil && s.breaker.state == breakerClosed {
+				rep = s.connect(ctx)
+			}
+		case <-s.idleTimer(rep, lastRequest):
+			log.Printf("[W] terminated after idle for %v", s.idleTimeout)
+			rep.terminate()
+			rep = nil
+			s.discardStandby()
+		case <-s.heartbeatTimer(rep, lastRequest, lastPing):
+			lastPing = time.Now()
+			if !s.checkHeartbeat(rep) {
+				s.setLastError("[W] does not respond to heartbeat")
+				rep.terminate()
+				log.Printf("[W] terminated; retry")
+				rep = s.connect(ctx)
+			}
+		case <-recovery:
+			recovery = nil
+			s.breaker.set(breakerHalfOpen)
+			s.recovering.Add(1)
+			go func() {
+				defer s.recovering.Done()
+				r, err := s.nextRepeater(ctx)
+				if err != nil {
+					log.Print(err)
+					s.setLastError(err.Error())
+				}
+				select {
+				case recovered <- r:
+				case <-ctx.Done():
+					if r != nil {
+						r.terminate()
+					}
+				}
+			}()
+		case r := <-recovered:
+			if rep != nil {
+				// restarted meanwhile, e.g. by restart-repeater; keep the live one
+				if r != nil {
+					r.terminate()
+				}
+			} else if r == nil {
+				s.breaker.fail()
+			} else {
+				s.breaker.succeed()
+				rep = r
+			}
 		}
-		defer rep.terminate()
 
-		// process a pending request if any
-		if pendingRequest != nil && handleRequest(rep, pendingRequest) != nil {
-			// fail
-			retryCount += 1
-			log.Printf("failed to process request (%d/3)", retryCount)
-			if retryCount == 3 {
-				log.Printf("give up")
-				break
+		// a new repeater is not idle yet, however long ago the last request was
+		if rep != nil && rep != prev {
+			lastRequest = time.Now()
+		}
+	}
+}
+
+// invoke PowerShell.exe, retrying with backoff until the breaker opens
+func (s *server) connect(ctx context.Context) *repeater {
+	atomic.StoreInt32(&s.starting, 1)
+	defer atomic.StoreInt32(&s.starting, 0)
+	for {
+		rep, err := s.nextRepeater(ctx)
+		if err == nil {
+			s.breaker.succeed()
+			return rep
+		}
+		log.Print(err)
+		s.setLastError(err.Error())
+
+		s.breaker.fail()
+		if s.breaker.state != breakerClosed {
+			return nil
+		}
+
+		delay := s.breaker.backoff()
+		log.Printf("retry in %v", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// SSH_AGENT_FAILURE
+var failureResponse = response{0, 0, 0, 1, 5}
+
+// process a request and returns the repeater for the next one; PowerShell.exe
+// is restarted up to 3 times if it fails, and the client gets SSH_AGENT_FAILURE
+// if it still fails or PowerShell.exe is down
+func (s *server) serve(ctx context.Context, rep *repeater, req *request) *repeater {
+	retryCount := 0
+	for {
+		if rep == nil && s.breaker.state == breakerClosed {
+			rep = s.connect(ctx)
+		}
+		if rep == nil {
+			log.Printf("[W] is down; return failure")
+			s.count(func(st *stats) { st.Failures += 1 })
+			req.resultChannel <- failureResponse
+			return nil
+		}
+
+		if s.handleRequest(rep, req) == nil {
+			return rep
+		}
+
+		// fail
+		rep.terminate()
+		rep = nil
+		retryCount += 1
+		log.Printf("failed to process request (%d/3)", retryCount)
+		if retryCount == 3 || ctx.Err() != nil {
+			log.Printf("give up; return failure")
+			s.count(func(st *stats) { st.Failures += 1 })
+			req.resultChannel <- failureResponse
+			return nil
+		}
+		log.Printf("[W] terminated; retry")
+	}
+}
+
+// get a repeater to serve requests; the standby one is promoted if ready
+func (s *server) nextRepeater(ctx context.Context) (*repeater, error) {
+	var rep *repeater
+
+	if s.standby {
+		select {
+		case rep = <-s.standbyQueue:
+			_, err := rep.ping()
+			if err == nil {
+				log.Printf("[W] standby promoted")
+			} else {
+				log.Printf("[W] standby does not respond: %s", err)
+				rep.terminate()
+				rep = nil
 			}
-		} else {
-			// process requests sequentially
-			for req := range requestQueue {
-				retryCount = 0
-				pendingRequest = &req
-				if handleRequest(rep, pendingRequest) != nil {
-					break
+		default:
+		}
+	}
+
+	if rep == nil {
+		var err error
+		powershells, script, options := s.repeaterSettings()
+		rep, err = newRepeater(ctx, powershells, script, options)
+		if err != nil {
+			if errors.Is(err, errIncompatibleScript) {
+				log.Printf("%s; exit", err)
+				s.cancel()
+			}
+			return nil, err
+		}
+	}
+
+	s.health.Lock()
+	s.health.info = rep.info
+	s.health.transport = rep.cmd.Path
+	s.health.starts += 1
+	s.health.Unlock()
+
+	if s.standby {
+		s.wantStandby()
+	}
+	return rep, nil
+}
+
+// ask keepStandby for a standby repeater; this also tells it that requests
+// are still coming
+func (s *server) wantStandby() {
+	select {
+	case s.standbyWanted <- struct{}{}:
+	default:
+	}
+}
+
+// keep a pre-started repeater so that a failed one can be replaced instantly;
+// the standby is discarded when no request comes in standbyIdle, and started
+// again on the next request
+func (s *server) keepStandby(ctx context.Context) {
+	idle := time.NewTimer(s.standbyIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.discardStandby()
+			return
+		case <-idle.C:
+			if s.discardStandby() {
+				log.Printf("[W] standby discarded after idle for %v", s.standbyIdle)
+			}
+		case <-s.standbyWanted:
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
 				}
 			}
+			idle.Reset(s.standbyIdle)
+
+			// prepare a new one unless the standby is still waiting
+			if len(s.standbyQueue) == 0 {
+				powershells, script, options := s.repeaterSettings()
+				rep, err := newRepeater(ctx, powershells, script, options)
+				if err != nil {
+					log.Printf("failed to prepare a standby [W]: %s", err)
+					continue
+				}
+				log.Printf("[W] standby ready")
+				s.standbyQueue <- rep
+			}
 		}
+	}
+}
 
+func (s *server) discardStandby() bool {
+	select {
+	case rep := <-s.standbyQueue:
+		rep.terminate()
+		return true
+	default:
+		return false
+	}
+}
+
+// a channel that fires when [W] should be pinged, the heartbeat period after the
+// last request or ping, so that the other tasks of the loop (e.g., the watchdog)
+// do not put it off; nil if heartbeat is disabled
+func (s *server) heartbeatTimer(rep *repeater, lastRequest, lastPing time.Time) <-chan time.Time {
+	if rep == nil || s.heartbeat <= 0 {
+		return nil
+	}
+	last := lastRequest
+	if lastPing.After(last) {
+		last = lastPing
+	}
+	return time.After(time.Until(last.Add(s.heartbeat)))
+}
+
+// a channel that fires when the repeater has been idle for idleTimeout; nil if
+// idle shutdown is disabled
+func (s *server) idleTimer(rep *repeater, lastRequest time.Time) <-chan time.Time {
+	if rep == nil || s.idleTimeout <= 0 {
+		return nil
+	}
+	return time.After(time.Until(lastRequest.Add(s.idleTimeout)))
+}
+
+// tell the server that a client has connected
+func (s *server) wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// ping [W] and returns false if it should be restarted
+func (s *server) checkHeartbeat(rep *repeater) bool {
+	rtt, err := rep.ping()
+	s.count(func(st *stats) { st.Pings += 1 })
+	if err != nil {
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("[W] heartbeat failed: %s", err)
+			return false
+		}
+		rep.missedPings += 1
+		s.count(func(st *stats) { st.MissedPings += 1 })
+		log.Printf("[W] missed a pong (%d/%d)", rep.missedPings, s.heartbeatMisses)
+		return rep.missedPings < s.heartbeatMisses
+	}
+	rep.missedPings = 0
+	log.Printf("[L] <- [W] pong (%v)", rtt)
+
+	s.health.Lock()
+	s.health.pingAt = time.Now()
+	s.health.pingRTT = rtt
+	s.health.Unlock()
+
+	return true
+}
+
+// record the state of the repeater for the status command
+func (s *server) updateHealth(rep *repeater) {
+	s.health.Lock()
+	prev := s.health.state
+	s.health.breaker = s.breaker.state
+	switch {
+	case rep != nil:
+		s.health.state = "running"
+	case s.breaker.state != breakerClosed:
+		s.health.state = "down"
+	default:
+		s.health.state = "stopped"
+	}
+	state := s.health.state
+	s.health.Unlock()
+
+	if state != prev {
+		s.notifyState(state)
+	}
+}
+
+// tell systemd the state of the repeater; the daemon is ready once it listens
+// on the sockets, even while the repeater is down
+func (s *server) notifyState(state string) {
+	if s.notifier == nil {
+		return
+	}
+
+	st := s.status()
+	msg := "STATUS=repeater " + state
+	switch {
+	case state == "running" && st.PipeName != "":
+		msg += fmt.Sprintf(", named pipe %s (%s)", st.PipeName, st.Pipe)
+	case state == "down" && st.LastError != "":
+		msg += ": " + st.LastError
+	case state == "stopped" && s.lazy:
+		msg += "; waiting for clients"
+	}
+	s.notifier.notify(msg)
+}
+
+// ping the watchdog of systemd while the server loop responds, so that systemd
+// restarts a wedged daemon; a down repeater is retried by the daemon itself,
+// and reported by STATUS=
+func (s *server) watchdog(ctx context.Context) {
+	interval := s.notifier.watchdog / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("[W] terminated")
 			return
-		default:
-			log.Printf("[W] terminated; retry")
+		case <-ticker.C:
+		}
+
+		check, cancel := context.WithTimeout(ctx, interval)
+		err := s.inLoop(check, func(rep *repeater) *repeater { return rep })
+		cancel()
+		if err != nil && atomic.LoadInt32(&s.starting) == 0 {
+			log.Printf("watchdog: the server loop does not respond")
+			continue
 		}
+		s.notifier.notify("WATCHDOG=1")
 	}
 }
 
-type deadliner interface {
-	SetReadDeadline(time.Time) error
+func (s *server) count(update func(*stats)) {
+	s.health.Lock()
+	update(&s.health.stats)
+	s.health.Unlock()
+}
+
+func (s *server) setLastError(msg string) {
+	s.health.Lock()
+	s.health.lastError = msg
+	s.health.lastErrorAt = time.Now()
+	s.health.Unlock()
 }
 
 var readTimeLimit = 10 * time.Second
 
-func handleRequest(rep *repeater, req *request) error {
+func (s *server) handleRequest(rep *repeater, req *request) error {
 	_, err := rep.in.Write(req.data)
 	if err != nil {
 		log.Printf("failed to write to [W]: %s", err)
+		s.setLastError(fmt.Sprintf("failed to write to [W]: %s", err))
 		return err
 	}
 	log.Printf("[L] -> [W] (%d B)", len(req.data))
 
-	if out, ok := rep.out.(deadliner); ok {
-		err = out.SetReadDeadline(time.Now().Add(readTimeLimit))
-		if err != nil {
-			log.Printf("failed to set timeout: %s", err)
-		}
-	}
+	rep.setReadDeadline(time.Now().Add(readTimeLimit))
 
-	resp, err := readMessage(rep.out)
+	resp, err := rep.readReply()
 	if err != nil {
 		log.Printf("failed to read from [W]: %s", err)
+		s.setLastError(fmt.Sprintf("failed to read from [W]: %s", err))
 		return err
 	}
 	log.Printf("[L] <- [W] (%d B)", len(resp))
 
-	if out, ok := rep.out.(deadliner); ok {
-		err = out.SetReadDeadline(time.Time{})
-		if err != nil {
-			log.Printf("failed to set timeout: %s", err)
-		}
+	rep.setReadDeadline(time.Time{})
+
+	// [W] itself is fine; restarting it does not help
+	if perr, ok := parsePipeError(resp); ok {
+		advice := perr.advice(rep.info.PipeName)
+		log.Print(advice)
+		s.setLastError(advice)
+		s.count(func(st *stats) { st.PipeErrors += 1 })
+		resp = failureResponse
 	}
 
 	req.resultChannel <- resp
@@ -172,6 +734,9 @@ func (s *server) client(wg *sync.WaitGroup, ctx context.Context, sshClient net.C
 	defer wg.Done()
 	defer sshClient.Close()
 
+	client := s.addClient(sshClient)
+	defer s.removeClient(client)
+
 	resChan := make(chan response)
 
 	for {
@@ -181,22 +746,42 @@ func (s *server) client(wg *sync.WaitGroup, ctx context.Context, sshClient net.C
 		}
 		log.Printf("ssh -> [L] (%d B)", len(req))
 
-		requestQueue <- request{data: req, resultChannel: resChan}
-		resp, ok := <-resChan
-		if !ok {
-			log.Printf("failed to get result")
-			break
+		var resp response
+		if isInternalMessage(req) {
+			log.Printf("reject a message of type 0x%x from ssh", req[4])
+			s.count(func(st *stats) { st.Failures += 1 })
+			resp = failureResponse
+		} else {
+			var ok bool
+			requestQueue <- request{data: req, resultChannel: resChan}
+			resp, ok = <-resChan
+			if !ok {
+				log.Printf("failed to get result")
+				break
+			}
 		}
 		_, err = sshClient.Write(resp)
 		if err != nil {
 			log.Printf("failed to write to ssh: %s", err)
 			break
 		}
+		s.count(func(st *stats) {
+			st.Requests += 1
+			st.BytesIn += int64(len(req))
+			st.BytesOut += int64(len(resp))
+		})
+		s.clients.Lock()
+		client.Requests += 1
+		s.clients.Unlock()
 		log.Printf("ssh <- [L] (%d B)", len(resp))
 	}
 	log.Printf("ssh: closed")
 }
 
+// the limit of a message, the same as AGENT_MAX_LEN of OpenSSH; a garbage
+// length field must not make a huge allocation
+const maxMessageLength = 256 * 1024
+
 func readMessage(from io.Reader) ([]byte, error) {
 	// In ssh-agent protocol, any message consists of:
 	//
@@ -217,6 +802,9 @@ func readMessage(from io.Reader) ([]byte, error) {
 	if err != nil {
 		log.Fatal("unreachable")
 	}
+	if n > maxMessageLength {
+		return nil, fmt.Errorf("too long message: %d bytes", n)
+	}
 
 	body := make([]byte, n)
 	_, err = io.ReadFull(from, body)
@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 )
 
-func setupDummyServer(t *testing.T) string {
+func setupDummyServer(t *testing.T, options ...func(*config)) string {
 	t.Helper()
 
 	tmpDir := setupDummyEnv(t)
@@ -20,17 +23,24 @@ func setupDummyServer(t *testing.T) string {
 require "socket"
 File.write('` + tmpDir + `/pid', $$.to_s)
 $stdout.sync = true
-$stdout << "\xff"
-s = $stdin.read(` + fmt.Sprintf("%d", len(repeaterPs1)) + `)
-len = $stdin.read(4)
-pipename = $stdin.read(len.unpack1("N"))
+` + dummyHandshake(protocolVersion) + `
 loop do
 	# echo
 	len = $stdin.read(4)
 	data = $stdin.read(len.unpack1("N"))
 	exit if data == "fail"
 	sleep if data == "stuck"
-	$stdout << len + data.upcase
+	if data == "hang"
+		$stdout << len + data.upcase
+		sleep
+	end
+	if data == "nopipe"
+		err = '{"error":"missing","message":"no pipe"}'
+		$stdout << [err.bytesize + 1].pack("N") + "\xf1" + err
+		next
+	end
+	data = $$.to_s if data == "pid"
+	$stdout << [data.bytesize].pack("N") + data.upcase
 end
 `
 
@@ -40,7 +50,19 @@ end
 	}
 
 	path := filepath.Join(tmpDir, "tmp.sock")
-	s := newServer(path, powershellPath(), "dummy-pipe-name")
+	c := &config{
+		socketPath:      path,
+		controlPath:     path + ".ctl",
+		powershellPaths: lookupPowerShells(t, "powershell"),
+		script:          repeaterPs1,
+		pipeName:        "dummy-pipe-name",
+		pipeTimeout:     time.Second,
+		retry:           retryPolicy{initial: 100 * time.Millisecond, max: 200 * time.Millisecond, threshold: 1},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	s := newServer(c)
 
 	done := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
@@ -137,16 +159,7 @@ func TestServerRestart(t *testing.T) {
 	}
 
 	// stop the dummy PowerShell.exe
-	pidStr, err := os.ReadFile(filepath.Join(filepath.Dir(path), "pid"))
-	if err != nil {
-		t.Fatal("no pid file")
-	}
-	var pid int
-	_, err = fmt.Sscanf(string(pidStr), "%d", &pid)
-	if err != nil {
-		t.Fatal("pid file is wrong")
-	}
-	proc, err := os.FindProcess(pid)
+	proc, err := os.FindProcess(readDummyPid(t, path))
 	if err != nil {
 		t.Fatal("no process found")
 	}
@@ -168,6 +181,16 @@ func TestServerRestart(t *testing.T) {
 	}
 }
 
+func expectFailure(t *testing.T, sock net.Conn) {
+	t.Helper()
+
+	buf := make([]byte, 4+1)
+	n, err := io.ReadFull(sock, buf)
+	if err != nil || n != 4+1 || string(buf) != "\x00\x00\x00\x01\x05" {
+		t.Errorf("it should return SSH_AGENT_FAILURE: %v", err)
+	}
+}
+
 func TestServerFail(t *testing.T) {
 	path := setupDummyServer(t)
 
@@ -182,11 +205,7 @@ func TestServerFail(t *testing.T) {
 		t.Errorf("failed to communicate: %v", err)
 	}
 
-	buf := make([]byte, 1)
-	_, err = io.ReadFull(sock, buf)
-	if err != io.EOF {
-		t.Errorf("it should fail with EOF: %v", err)
-	}
+	expectFailure(t, sock)
 }
 
 func TestServerStuck(t *testing.T) {
@@ -209,9 +228,350 @@ func TestServerStuck(t *testing.T) {
 		t.Errorf("failed to communicate: %v", err)
 	}
 
-	buf := make([]byte, 1)
+	expectFailure(t, sock)
+}
+
+// the pid of the dummy PowerShell.exe invoked last
+func readDummyPid(t *testing.T, path string) int {
+	t.Helper()
+
+	pidStr, err := os.ReadFile(filepath.Join(filepath.Dir(path), "pid"))
+	if err != nil {
+		t.Fatal("no pid file")
+	}
+	var pid int
+	_, err = fmt.Sscanf(string(pidStr), "%d", &pid)
+	if err != nil {
+		t.Fatal("pid file is wrong")
+	}
+	return pid
+}
+
+// the pid of the dummy PowerShell.exe serving the request
+func requestPid(t *testing.T, sock net.Conn) int {
+	t.Helper()
+
+	_, err := sock.Write([]byte("\x00\x00\x00\x03pid"))
+	if err != nil {
+		t.Fatalf("failed to communicate: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(sock, buf)
+	if err != nil {
+		t.Fatalf("failed to communicate: %v", err)
+	}
+	buf = make([]byte, int(buf[3]))
 	_, err = io.ReadFull(sock, buf)
-	if err != io.EOF {
-		t.Errorf("it should fail with EOF: %v", err)
+	if err != nil {
+		t.Fatalf("failed to communicate: %v", err)
+	}
+
+	var pid int
+	_, err = fmt.Sscanf(string(buf), "%d", &pid)
+	if err != nil {
+		t.Fatalf("wrong pid: %s", string(buf))
+	}
+	return pid
+}
+
+func TestServerPipeError(t *testing.T) {
+	path := setupDummyServer(t)
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	pid := requestPid(t, sock)
+
+	_, err = sock.Write([]byte("\x00\x00\x00\x06nopipe"))
+	if err != nil {
+		t.Errorf("failed to communicate: %v", err)
+	}
+	expectFailure(t, sock)
+
+	if requestPid(t, sock) != pid {
+		t.Errorf("PowerShell should not be restarted for a pipe error")
+	}
+}
+
+func TestServerInternalMessage(t *testing.T) {
+	path := setupDummyServer(t)
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	pid := requestPid(t, sock)
+
+	// a ping or a pipe error from a client must not reach [W]
+	for _, msg := range []string{"\x00\x00\x00\x01\xf0", "\x00\x00\x00\x02\xf1x"} {
+		_, err = sock.Write([]byte(msg))
+		if err != nil {
+			t.Errorf("failed to communicate: %v", err)
+		}
+		expectFailure(t, sock)
+	}
+
+	if requestPid(t, sock) != pid {
+		t.Errorf("PowerShell should not be restarted for an internal message")
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	path := setupDummyServer(t)
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	requestPid(t, sock)
+
+	st, err := queryStatus(path + ".ctl")
+	if err != nil {
+		t.Fatalf("failed to query the status: %v", err)
+	}
+	if st.Pid != os.Getpid() || st.Socket != path || st.Repeater != "running" || st.PipeName != "dummy-pipe-name" || st.PSVersion != "7.4.0" || st.Clients != 1 || !st.healthy() {
+		t.Errorf("wrong status: %+v", st)
+	}
+
+	_, err = sock.Write([]byte("\x00\x00\x00\x06nopipe"))
+	if err != nil {
+		t.Errorf("failed to communicate: %v", err)
+	}
+	expectFailure(t, sock)
+
+	st, err = queryStatus(path + ".ctl")
+	if err != nil || st.LastError == "" || st.LastErrorAt == nil {
+		t.Errorf("the pipe error should be reported: %+v (%v)", st, err)
+	}
+
+	_, err = queryStatus(filepath.Join(filepath.Dir(path), "none.sock.ctl"))
+	if !errors.Is(err, errNotRunning) {
+		t.Errorf("should not be running: %v", err)
+	}
+}
+
+func TestServerReplace(t *testing.T) {
+	path := setupDummyServer(t)
+
+	old, err := queryStatus(path + ".ctl")
+	if err != nil {
+		t.Fatalf("failed to query the status: %v", err)
+	}
+
+	setupDummyServer(t, func(c *config) {
+		c.socketPath = path
+		c.controlPath = path + ".ctl"
+		c.pipeName = "another-pipe-name"
+		c.replacePid = os.Getpid()
+	})
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+	requestPid(t, sock)
+
+	st, err := queryStatus(path + ".ctl")
+	if err != nil || st.PipeName != "another-pipe-name" || !st.StartedAt.After(old.StartedAt) {
+		t.Errorf("the new server should serve: %+v (%v)", st, err)
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		t.Errorf("the socket should be left for the new server: %v", err)
+	}
+}
+
+func TestServerStandby(t *testing.T) {
+	path := setupDummyServer(t, func(c *config) {
+		c.standby = true
+		c.standbyIdle = time.Minute
+	})
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	pid1 := requestPid(t, sock)
+
+	// wait for the standby to be ready, and stop the active one
+	time.Sleep(500 * time.Millisecond)
+	standbyPid := readDummyPid(t, path)
+	if standbyPid == pid1 {
+		t.Fatal("no standby is invoked")
+	}
+	proc, err := os.FindProcess(pid1)
+	if err != nil {
+		t.Fatal("no process found")
+	}
+	err = proc.Signal(os.Interrupt)
+	if err != nil {
+		t.Fatal("failed to kill the process")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	pid2 := requestPid(t, sock)
+	if pid2 != standbyPid {
+		t.Errorf("the standby should be promoted: %d (expected: %d)", pid2, standbyPid)
+	}
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	pingTimeLimitBackup := pingTimeLimit
+	pingTimeLimit = 200 * time.Millisecond
+	t.Cleanup(func() {
+		pingTimeLimit = pingTimeLimitBackup
+	})
+
+	path := setupDummyServer(t, func(c *config) {
+		c.heartbeat = 100 * time.Millisecond
+		c.heartbeatMisses = 2
+	})
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	pid1 := requestPid(t, sock)
+
+	// pongs should be returned while idle
+	time.Sleep(300 * time.Millisecond)
+	if readDummyPid(t, path) != pid1 {
+		t.Fatal("the repeater should not be restarted")
+	}
+
+	// the dummy PowerShell.exe stops responding after this request
+	_, err = sock.Write([]byte("\x00\x00\x00\x04hang"))
+	if err != nil {
+		t.Errorf("failed to communicate: %v", err)
+	}
+	buf := make([]byte, 4+4)
+	n, err := io.ReadFull(sock, buf)
+	if err != nil || n != 4+4 || string(buf) != "\x00\x00\x00\x04HANG" {
+		t.Errorf("failed to communicate: %v", err)
+	}
+
+	// the repeater should be restarted without any request
+	time.Sleep(1 * time.Second)
+	if readDummyPid(t, path) == pid1 {
+		t.Errorf("the repeater should be restarted")
+	}
+
+	pid2 := requestPid(t, sock)
+	if pid2 == pid1 {
+		t.Errorf("the repeater should be restarted")
+	}
+}
+
+func TestServerDegraded(t *testing.T) {
+	path := setupDummyServer(t, func(c *config) {
+		c.powershellPaths = []string{filepath.Join(filepath.Dir(c.socketPath), "later.exe")}
+	})
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	// PowerShell.exe is not available
+	for i := 0; i < 2; i++ {
+		_, err = sock.Write([]byte("\x00\x00\x00\x05hello"))
+		if err != nil {
+			t.Errorf("failed to communicate: %v", err)
+		}
+		expectFailure(t, sock)
+	}
+
+	// PowerShell.exe gets available
+	dir := filepath.Dir(path)
+	err = os.Symlink(filepath.Join(dir, "powershell.exe"), filepath.Join(dir, "later.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	_, err = sock.Write([]byte("\x00\x00\x00\x05hello"))
+	if err != nil {
+		t.Errorf("failed to communicate: %v", err)
+	}
+	buf := make([]byte, 4+5)
+	n, err := io.ReadFull(sock, buf)
+	if err != nil || n != 4+5 || string(buf) != "\x00\x00\x00\x05HELLO" {
+		t.Errorf("failed to communicate: %v", err)
+	}
+}
+
+func TestServerLazy(t *testing.T) {
+	path := setupDummyServer(t, func(c *config) {
+		c.lazy = true
+		c.idleTimeout = 300 * time.Millisecond
+	})
+	pidPath := filepath.Join(filepath.Dir(path), "pid")
+
+	// PowerShell.exe should not be invoked until a client connects
+	time.Sleep(200 * time.Millisecond)
+	_, err := os.Stat(pidPath)
+	if err == nil {
+		t.Fatal("the repeater should not be invoked yet")
+	}
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = os.Stat(pidPath)
+	if err != nil {
+		t.Fatal("the repeater should be invoked")
+	}
+
+	// PowerShell.exe should be terminated after idle
+	pid1 := requestPid(t, sock)
+	time.Sleep(600 * time.Millisecond)
+	err = syscall.Kill(pid1, 0)
+	if err != syscall.ESRCH {
+		t.Errorf("the repeater should be terminated: %v", err)
+	}
+
+	// and invoked again on the next request
+	pid2 := requestPid(t, sock)
+	if pid2 == pid1 {
+		t.Errorf("the repeater should be invoked again")
+	}
+
+	// the repeater invoked by a client after idle for longer than
+	// idleTimeout serves the client, instead of being taken as idle
+	for i := 0; i < 3; i++ {
+		time.Sleep(600 * time.Millisecond)
+		sock, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer sock.Close()
+
+		time.Sleep(100 * time.Millisecond)
+		buf, err := os.ReadFile(pidPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid := requestPid(t, sock); strconv.Itoa(pid) != string(buf) {
+			t.Errorf("the repeater invoked on connection should serve the request: %d (expected: %s)", pid, buf)
+		}
 	}
 }
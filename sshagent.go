@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sshAgentUsage = `usage: ssh-agent [-c | -s] [-Dd] [-a bind_address] [-E fingerprint_hash]
+                 [-O option] [-P allowed_providers] [-t life] [command [arg ...]]
+       ssh-agent [-c | -s] -k`
+
+// invoked via a symlink named ssh-agent
+func isSSHAgentName(argv0 string) bool {
+	return filepath.Base(argv0) == "ssh-agent"
+}
+
+// translate the command line of OpenSSH's ssh-agent into the options of
+// wsl2-ssh-agent; the options about keys are for ssh-agent.exe, so they are
+// ignored with a warning
+func sshAgentArgs(args []string) ([]string, error) {
+	options := []string{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		arg := args[0][1:]
+		args = args[1:]
+		if arg == "-" {
+			break
+		}
+
+		// getopt style: "-sD", "-a sock", and "-asock"
+		for len(arg) > 0 {
+			opt := arg[0]
+			arg = arg[1:]
+
+			var value string
+			if strings.IndexByte("aEOPt", opt) >= 0 {
+				if arg != "" {
+					value, arg = arg, ""
+				} else if len(args) > 0 {
+					value, args = args[0], args[1:]
+				} else {
+					return nil, fmt.Errorf("option requires an argument -- %c", opt)
+				}
+			}
+
+			switch opt {
+			case 's':
+				options = append(options, "-format=sh")
+			case 'c':
+				options = append(options, "-format=csh")
+			case 'k':
+				options = append(options, "-k")
+			case 'D':
+				options = append(options, "-foreground")
+			case 'd':
+				options = append(options, "-foreground", "-verbose")
+			case 'a':
+				options = append(options, "-socket="+value)
+			case 'E', 'O', 'P', 't':
+				fmt.Fprintf(os.Stderr, "warning: ssh-agent -%c is not supported; ignored\n", opt)
+			default:
+				return nil, fmt.Errorf("unknown option -- %c", opt)
+			}
+		}
+	}
+
+	// "ssh-agent command args..." runs the command with a private agent
+	if len(args) > 0 {
+		options = append(append(options, "exec", "--"), args...)
+	}
+	return options, nil
+}
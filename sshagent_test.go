@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSHAgentArgs(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{}, ""},
+		{[]string{"-s"}, "-format=sh"},
+		{[]string{"-c", "-k"}, "-format=csh -k"},
+		{[]string{"-sk"}, "-format=sh -k"},
+		{[]string{"-a", "/tmp/agent.sock", "-D"}, "-socket=/tmp/agent.sock -foreground"},
+		{[]string{"-Da/tmp/agent.sock"}, "-foreground -socket=/tmp/agent.sock"},
+		{[]string{"-d"}, "-foreground -verbose"},
+		{[]string{"-t", "1h", "-s", "--"}, "-format=sh"},
+		{[]string{"-s", "bash", "-c", "ssh-add -l"}, "-format=sh exec -- bash -c ssh-add -l"},
+	}
+	for _, c := range cases {
+		args, err := sshAgentArgs(c.args)
+		if err != nil {
+			t.Errorf("%v: %s", c.args, err)
+			continue
+		}
+		if strings.Join(args, " ") != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, strings.Join(args, " "))
+		}
+	}
+
+	for _, args := range [][]string{{"-x"}, {"-a"}} {
+		_, err := sshAgentArgs(args)
+		if err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestIsSSHAgentName(t *testing.T) {
+	if !isSSHAgentName("/usr/local/bin/ssh-agent") || isSSHAgentName("wsl2-ssh-agent") {
+		t.Errorf("wrong detection")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// the exit codes of the status command
+const (
+	statusHealthy    = 0
+	statusDegraded   = 1
+	statusNotRunning = 3
+)
+
+type daemonStatus struct {
+	Pid             int        `json:"pid"`
+	Version         string     `json:"version"`
+	StartedAt       time.Time  `json:"startedAt"`
+	Uptime          float64    `json:"uptime"` // in seconds
+	Socket          string     `json:"socket"`
+	Activated       bool       `json:"activated,omitempty"`
+	PipeName        string     `json:"pipeName"`
+	Pipe            string     `json:"pipe"`
+	Transport       string     `json:"transport"`
+	PSVersion       string     `json:"psVersion"`
+	PSEdition       string     `json:"psEdition"`
+	SSHAgentVersion string     `json:"sshAgentVersion"`
+	Repeater        string     `json:"repeater"`
+	Breaker         string     `json:"breaker"`
+	Restarts        int        `json:"restarts"`
+	Clients         int        `json:"clients"`
+	PingRTT         float64    `json:"pingRTT,omitempty"` // in milliseconds
+	LastError       string     `json:"lastError,omitempty"`
+	LastErrorAt     *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+func (s *server) status() daemonStatus {
+	s.health.Lock()
+	defer s.health.Unlock()
+
+	restarts := s.health.starts - 1
+	if restarts < 0 {
+		restarts = 0
+	}
+
+	var lastErrorAt *time.Time
+	if s.health.lastError != "" {
+		at := s.health.lastErrorAt
+		lastErrorAt = &at
+	}
+
+	return daemonStatus{
+		Pid:             os.Getpid(),
+		Version:         version,
+		StartedAt:       s.startedAt,
+		Uptime:          time.Since(s.startedAt).Seconds(),
+		Socket:          s.socketPath,
+		Activated:       s.activated,
+		PipeName:        s.health.info.PipeName,
+		Pipe:            s.health.info.Pipe,
+		Transport:       s.health.transport,
+		PSVersion:       s.health.info.PSVersion,
+		PSEdition:       s.health.info.PSEdition,
+		SSHAgentVersion: s.health.info.SSHAgentVersion,
+		Repeater:        s.health.state,
+		Breaker:         s.health.breaker.String(),
+		Restarts:        restarts,
+		Clients:         s.clientCount(),
+		PingRTT:         float64(s.health.pingRTT) / float64(time.Millisecond),
+		LastError:       s.health.lastError,
+		LastErrorAt:     lastErrorAt,
+	}
+}
+
+func (st *daemonStatus) healthy() bool {
+	return st.Repeater != "down" && st.Breaker == breakerClosed.String() && (st.Pipe == "" || st.Pipe == "ok")
+}
+
+func queryStatus(controlPath string) (*daemonStatus, error) {
+	st := &daemonStatus{}
+	err := controlCall(controlPath, controlRequest{Command: "status"}, st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// the status command
+func runStatus(c *config, args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the status in JSON")
+	flags.Parse(args)
+
+	st, err := queryStatus(c.controlPath)
+	if err != nil {
+		if *asJSON {
+			printJSON(os.Stdout, map[string]string{"socket": c.socketPath, "error": err.Error()})
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if errors.Is(err, errNotRunning) {
+			return statusNotRunning
+		}
+		return statusDegraded
+	}
+
+	if *asJSON {
+		printJSON(os.Stdout, st)
+	} else {
+		printStatus(os.Stdout, st)
+	}
+
+	if !st.healthy() {
+		return statusDegraded
+	}
+	return statusHealthy
+}
+
+func printJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func printStatus(w io.Writer, st *daemonStatus) {
+	uptime := time.Duration(st.Uptime * float64(time.Second)).Round(time.Second)
+	fmt.Fprintf(w, "wsl2-ssh-agent %s (pid: %d) is running for %v\n", st.Version, st.Pid, uptime)
+	if st.Activated {
+		fmt.Fprintf(w, "  socket:        %s (socket activation)\n", st.Socket)
+	} else {
+		fmt.Fprintf(w, "  socket:        %s\n", st.Socket)
+	}
+	if st.PipeName != "" {
+		fmt.Fprintf(w, "  named pipe:    %s (%s)\n", st.PipeName, st.Pipe)
+	}
+	if st.Transport != "" {
+		fmt.Fprintf(w, "  transport:     %s\n", st.Transport)
+	}
+	if st.PSVersion != "" {
+		fmt.Fprintf(w, "  PowerShell:    %s (%s)\n", st.PSVersion, st.PSEdition)
+		fmt.Fprintf(w, "  ssh-agent.exe: %s\n", st.SSHAgentVersion)
+	}
+	fmt.Fprintf(w, "  repeater:      %s (breaker: %s)\n", st.Repeater, st.Breaker)
+	fmt.Fprintf(w, "  restarts:      %d\n", st.Restarts)
+	fmt.Fprintf(w, "  clients:       %d\n", st.Clients)
+	if st.PingRTT > 0 {
+		fmt.Fprintf(w, "  ping:          %.1fms\n", st.PingRTT)
+	}
+	if st.LastError != "" {
+		fmt.Fprintf(w, "  last error:    %s (%s)\n", st.LastError, st.LastErrorAt.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the interval to check if the stopped daemon has exited
+var stopPollInterval = 50 * time.Millisecond
+
+// how long to wait for the daemon started by systemd socket activation
+var activationTimeout = 2 * time.Second
+
+// the pid of the daemon serving the socket; the peer of the socket is the
+// process that created the listener, which is systemd under socket activation,
+// so the daemon's own answer on the control socket or its pid file wins
+func (c *config) daemonPid(peerPid int) int {
+	if peerPid == -1 {
+		return -1
+	}
+	deadline := time.Now().Add(activationTimeout)
+	for {
+		st, err := queryStatus(c.controlPath)
+		if err == nil {
+			return st.Pid
+		}
+		pid := readPidFile(pidPath(c.socketPath))
+		if pid > 0 && processAlive(pid) && isAgentExecutable(pid) {
+			return pid
+		}
+
+		// the connection to the socket has made systemd start the daemon,
+		// which writes the pid file soon
+		if isAgentExecutable(peerPid) || time.Now().After(deadline) {
+			return peerPid
+		}
+		time.Sleep(stopPollInterval)
+	}
+}
+
+// whether systemd listens on the socket and starts the daemon on demand: the
+// daemon says so, or the socket is created by systemd itself while the daemon
+// is not started yet
+func (c *config) socketActivated(peerPid int) bool {
+	if peerPid == -1 {
+		return false
+	}
+	st, err := queryStatus(c.controlPath)
+	if err == nil {
+		return st.Activated
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", peerPid))
+	return err == nil && strings.TrimSpace(string(comm)) == "systemd"
+}
+
+// whether the process listening on the socket is wsl2-ssh-agent: the daemon
+// answers its pid on the control socket, and an older one without the control
+// socket is identified by its executable
+func (c *config) isDaemonProcess(pid int) bool {
+	st, err := queryStatus(c.controlPath)
+	if err == nil {
+		return st.Pid == pid
+	}
+	return isAgentExecutable(pid)
+}
+
+func isAgentExecutable(pid int) bool {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false
+	}
+	self, err := os.Executable()
+	if err == nil && exe == self {
+		return true
+	}
+	return strings.HasPrefix(filepath.Base(exe), "wsl2-ssh-agent")
+}
+
+// whether the process exists; a zombie counts as exited
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return !errors.Is(err, os.ErrNotExist)
+	}
+	// "pid (comm) state ..."; comm may contain spaces and parentheses
+	i := strings.LastIndexByte(string(stat), ')')
+	return i < 0 || i+2 >= len(stat) || stat[i+2] != 'Z'
+}
+
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return true
+}
+
+// remove the socket if nobody listens on it
+func removeStaleSocket(path string) {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		log.Printf("remove the stale socket: %s", path)
+		os.Remove(path)
+	}
+}
+
+// send SIGTERM to the daemon and wait until it exits; SIGKILL it if it does
+// not exit in the timeout, and remove the sockets left behind
+func stopService(c *config, pid int) error {
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to stop wsl2-ssh-agent (pid: %d): %s", pid, err)
+	}
+
+	if !waitForExit(pid, c.stopTimeout) {
+		log.Printf("wsl2-ssh-agent (pid: %d) did not exit in %v; kill it", pid, c.stopTimeout)
+		err = syscall.Kill(pid, syscall.SIGKILL)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to kill wsl2-ssh-agent (pid: %d): %s", pid, err)
+		}
+		if !waitForExit(pid, c.stopTimeout) {
+			return fmt.Errorf("wsl2-ssh-agent (pid: %d) did not exit even after SIGKILL", pid)
+		}
+	}
+
+	removeStaleSocket(c.socketPath)
+	removeStaleSocket(c.controlPath)
+	removePidFile(pidPath(c.socketPath), pid)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startProcess(t *testing.T, script string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", script)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// wait for sh to set the trap
+	time.Sleep(100 * time.Millisecond)
+	return cmd
+}
+
+func TestStopService(t *testing.T) {
+	dir := t.TempDir()
+	c := &config{socketPath: filepath.Join(dir, "s"), controlPath: filepath.Join(dir, "s.ctl"), stopTimeout: 3 * time.Second}
+
+	// a socket left by a killed daemon
+	listener, err := net.Listen("unix", c.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	cmd := startProcess(t, "sleep 30")
+	if c.isDaemonProcess(cmd.Process.Pid) {
+		t.Errorf("sleep must not be wsl2-ssh-agent")
+	}
+
+	start := time.Now()
+	err = stopService(c, cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processAlive(cmd.Process.Pid) {
+		t.Errorf("the process is still alive")
+	}
+	if time.Since(start) > c.stopTimeout {
+		t.Errorf("SIGTERM must be enough: %v", time.Since(start))
+	}
+	_, err = os.Stat(c.socketPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("the stale socket must be removed: %v", err)
+	}
+}
+
+func TestStopServiceKill(t *testing.T) {
+	dir := t.TempDir()
+	c := &config{socketPath: filepath.Join(dir, "s"), controlPath: filepath.Join(dir, "s.ctl"), stopTimeout: 300 * time.Millisecond}
+
+	cmd := startProcess(t, "trap '' TERM; while :; do sleep 1; done")
+
+	start := time.Now()
+	err := stopService(c, cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processAlive(cmd.Process.Pid) {
+		t.Errorf("the process is still alive")
+	}
+	if time.Since(start) < c.stopTimeout {
+		t.Errorf("SIGTERM must be ignored: %v", time.Since(start))
+	}
+}
+
+func TestDaemonPid(t *testing.T) {
+	activationTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { activationTimeout = 2 * time.Second })
+
+	// the listener is created by another process, like systemd
+	systemd := startProcess(t, "sleep 30")
+	dir := t.TempDir()
+	c := &config{socketPath: filepath.Join(dir, "s"), controlPath: filepath.Join(dir, "s.ctl")}
+
+	// not started yet, or not wsl2-ssh-agent
+	if pid := c.daemonPid(systemd.Process.Pid); pid != systemd.Process.Pid {
+		t.Errorf("should fall back to the peer: %d", pid)
+	}
+
+	// the pid file of the daemon
+	err := os.WriteFile(pidPath(c.socketPath), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid := c.daemonPid(systemd.Process.Pid); pid != os.Getpid() {
+		t.Errorf("should be the pid in the pid file: %d", pid)
+	}
+
+	// the pid file of a dead daemon
+	err = os.WriteFile(pidPath(c.socketPath), []byte("999999999\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid := c.daemonPid(systemd.Process.Pid); pid != systemd.Process.Pid {
+		t.Errorf("should ignore the stale pid file: %d", pid)
+	}
+
+	// the control socket answers the pid of the daemon
+	path := setupDummyServer(t)
+	c = &config{socketPath: path, controlPath: path + ".ctl"}
+	if pid := c.daemonPid(systemd.Process.Pid); pid != os.Getpid() {
+		t.Errorf("should be the pid answered on the control socket: %d", pid)
+	}
+	if c.isDaemonProcess(systemd.Process.Pid) {
+		t.Errorf("the peer must not be taken as the daemon")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the first file descriptor passed by systemd socket activation
+var listenFdsStart = 3
+
+// the listening sockets passed by systemd socket activation (LISTEN_FDS); the
+// one named "control" by FileDescriptorName= is the control socket, and the
+// first other one is the agent socket
+func systemdListeners() (net.Listener, net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// not to be inherited by PowerShell
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var agent, control net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		// net.FileListener dups the fd with close-on-exec
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid socket passed by systemd (fd: %d): %s", fd, err)
+		}
+
+		if listener.Addr().Network() != "unix" {
+			log.Printf("ignore the socket passed by systemd: %s", listener.Addr())
+			listener.Close()
+		} else if name == "control" && control == nil {
+			control = listener
+		} else if agent == nil {
+			agent = listener
+		} else {
+			log.Printf("ignore the socket passed by systemd: %s", listener.Addr())
+			listener.Close()
+		}
+	}
+
+	if agent == nil {
+		if control != nil {
+			control.Close()
+		}
+		return nil, nil, fmt.Errorf("no agent socket passed by systemd")
+	}
+	return agent, control, nil
+}
+
+// sd_notify(3): tell systemd the state of the daemon through NOTIFY_SOCKET
+type notifier struct {
+	conn     net.Conn
+	watchdog time.Duration // WATCHDOG_USEC, or 0 if disabled
+}
+
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	var watchdog time.Duration
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if err == nil && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		watchdog = time.Duration(usec) * time.Microsecond
+	}
+
+	// not to be inherited by the children
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	// "@..." is an abstract socket, which net handles as well
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		log.Printf("failed to connect to NOTIFY_SOCKET: %s", err)
+		return nil
+	}
+	return &notifier{conn: conn, watchdog: watchdog}
+}
+
+// send "KEY=value" lines; nothing happens without NOTIFY_SOCKET
+func (n *notifier) notify(state string) {
+	if n == nil {
+		return
+	}
+	_, err := n.conn.Write([]byte(state))
+	if err != nil {
+		log.Printf("failed to notify systemd: %s", err)
+	}
+}
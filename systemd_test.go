@@ -0,0 +1,284 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pass the listeners at the fds from 100 like systemd does from 3
+func passListeners(t *testing.T, names string, paths ...string) {
+	listenFdsStart = 100
+	t.Cleanup(func() { listenFdsStart = 3 })
+
+	for i, path := range paths {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		f, err := listener.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = syscall.Dup2(int(f.Fd()), listenFdsStart+i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		listener.Close()
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(paths)))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	agent, control, err := systemdListeners()
+	if agent != nil || control != nil || err != nil {
+		t.Fatalf("not activated, but got %v, %v, %v", agent, control, err)
+	}
+
+	dir := t.TempDir()
+	passListeners(t, "control:agent", filepath.Join(dir, "s.ctl"), filepath.Join(dir, "s"))
+
+	agent, control, err = systemdListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	defer control.Close()
+	if agent.Addr().String() != filepath.Join(dir, "s") || control.Addr().String() != filepath.Join(dir, "s.ctl") {
+		t.Errorf("wrong sockets: %s, %s", agent.Addr(), control.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_FDS must be unset")
+	}
+}
+
+func TestServerSocketActivation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "activated.sock")
+	passListeners(t, "wsl2-ssh-agent.socket", path)
+
+	t.Run("server", func(t *testing.T) {
+		setupDummyServer(t, func(c *config) {
+			var err error
+			c.listener, c.controlListener, err = systemdListeners()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.socketPath = path
+			c.controlPath = path + ".ctl"
+		})
+
+		sock, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sock.Close()
+		if requestPid(t, sock) <= 0 {
+			t.Errorf("no response via the activated socket")
+		}
+
+		// -stop and -replace must leave it to systemctl
+		c := &config{controlPath: path + ".ctl"}
+		if !c.socketActivated(findRunningServerPid(path)) {
+			t.Errorf("should be socket activation")
+		}
+	})
+
+	// the socket belongs to systemd, but the control socket does not
+	_, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("the activated socket must be left: %v", err)
+	}
+	_, err = os.Stat(path + ".ctl")
+	if !os.IsNotExist(err) {
+		t.Errorf("the control socket must be removed: %v", err)
+	}
+}
+
+func TestSocketActivatedNot(t *testing.T) {
+	path := setupDummyServer(t)
+	c := &config{controlPath: path + ".ctl"}
+	if c.socketActivated(findRunningServerPid(path)) {
+		t.Errorf("should not be socket activation")
+	}
+	if c.socketActivated(-1) {
+		t.Errorf("nothing listens")
+	}
+}
+
+// the messages sent to NOTIFY_SOCKET until all the expected ones arrive
+func readNotifications(t *testing.T, conn *net.UnixConn, expected ...string) string {
+	t.Helper()
+
+	messages := ""
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		missing := false
+		for _, e := range expected {
+			if !strings.Contains(messages, e) {
+				missing = true
+			}
+		}
+		if !missing {
+			return messages
+		}
+
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected %q, got %q: %v", expected, messages, err)
+		}
+		messages += string(buf[:n]) + "\n"
+	}
+}
+
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func TestServerNotify(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "200000")
+
+	setupDummyServer(t)
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Errorf("NOTIFY_SOCKET must be unset")
+	}
+
+	messages := readNotifications(t, conn, "READY=1", "STATUS=repeater running, named pipe dummy-pipe-name (ok)", "WATCHDOG=1")
+	if strings.Index(messages, "READY=1") > strings.Index(messages, "WATCHDOG=1") {
+		t.Errorf("WATCHDOG=1 before READY=1: %q", messages)
+	}
+}
+
+func TestServerNotifyLazy(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	setupDummyServer(t, func(c *config) { c.lazy = true })
+
+	readNotifications(t, conn, "READY=1", "STATUS=repeater stopped; waiting for clients")
+}
+
+func TestServerNotifyDegraded(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "200000")
+
+	// the daemon stays up while PowerShell.exe is not available
+	setupDummyServer(t, func(c *config) {
+		c.powershellPaths = []string{filepath.Join(filepath.Dir(c.socketPath), "later.exe")}
+	})
+
+	messages := readNotifications(t, conn, "READY=1", "STATUS=repeater down", "WATCHDOG=1")
+	if strings.Index(messages, "READY=1") > strings.Index(messages, "STATUS=repeater down") {
+		t.Errorf("READY=1 should not wait for the repeater: %q", messages)
+	}
+}
+
+func TestServerHeartbeatWithWatchdog(t *testing.T) {
+	pingTimeLimitBackup := pingTimeLimit
+	pingTimeLimit = 200 * time.Millisecond
+	t.Cleanup(func() {
+		pingTimeLimit = pingTimeLimitBackup
+	})
+
+	// the watchdog runs the server loop more often than the heartbeat
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	path := setupDummyServer(t, func(c *config) {
+		c.heartbeat = 300 * time.Millisecond
+		c.heartbeatMisses = 1
+	})
+	readNotifications(t, conn, "WATCHDOG=1")
+
+	// keep reading like systemd; the server blocks if the queue is full
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			_, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer sock.Close()
+	pid1 := requestPid(t, sock)
+
+	// the dummy PowerShell.exe stops responding after this request
+	_, err = sock.Write([]byte("\x00\x00\x00\x04hang"))
+	if err != nil {
+		t.Fatalf("failed to communicate: %v", err)
+	}
+	buf := make([]byte, 4+4)
+	_, err = io.ReadFull(sock, buf)
+	if err != nil || string(buf) != "\x00\x00\x00\x04HANG" {
+		t.Fatalf("failed to communicate: %v", err)
+	}
+
+	// the heartbeat should still detect it
+	time.Sleep(1500 * time.Millisecond)
+	if readDummyPid(t, path) == pid1 {
+		t.Errorf("the repeater should be restarted by the heartbeat")
+	}
+}
+
+func TestServerWatchdogWhileStarting(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "200000")
+
+	// PowerShell.exe never starts up, so the server loop is busy for seconds
+	setupDummyServer(t, func(c *config) {
+		broken := filepath.Join(filepath.Dir(c.socketPath), "broken.exe")
+		err := os.WriteFile(broken, []byte(dummyBrokenPowerShell), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.powershellPaths = []string{broken}
+	})
+
+	messages := ""
+	conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	for !strings.Contains(messages, "WATCHDOG=1") {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("the watchdog should be pinged while invoking PowerShell: %q (%v)", messages, err)
+		}
+		messages += string(buf[:n]) + "\n"
+	}
+
+	// keep reading like systemd until the server exits
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			_, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
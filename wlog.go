@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"html"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (level logLevel) String() string {
+	switch level {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+func parseLogLevel(name string) (logLevel, bool) {
+	for _, level := range []logLevel{levelDebug, levelInfo, levelWarn, levelError} {
+		if name == level.String() {
+			return level, true
+		}
+	}
+	return levelError, false
+}
+
+// the log entries below this level are discarded
+var minLogLevel = int32(levelInfo)
+
+func logEnabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLogLevel)
+}
+
+// the log of [L] goes through this, so that set-log-level applies to it as
+// well; [L] logs at the info level
+type levelGate struct {
+	out io.Writer
+}
+
+func (gate levelGate) Write(p []byte) (int, error) {
+	if !logEnabled(levelInfo) {
+		return len(p), nil
+	}
+	return gate.out.Write(p)
+}
+
+// "[W] 2006/01/02 15:04:05 msg" written by Log in repeater.ps1
+var wLogPattern = regexp.MustCompile(`^\[W\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d (.*)$`)
+
+// the elements of PowerShell's CLIXML output that we care about
+var (
+	clixmlStringPattern   = regexp.MustCompile(`<S S="(\w+)">([^<]*)</S>`)
+	clixmlProgressPattern = regexp.MustCompile(`<Obj S="progress"[^>]*>.*?<AV>([^<]*)</AV>`)
+	clixmlEscapePattern   = regexp.MustCompile(`_x([0-9A-Fa-f]{4})_`)
+)
+
+// how long to wait for the rest of a PowerShell exception
+var wLogFlushDelay = 100 * time.Millisecond
+
+// relay the stderr of [W] to the daemon's logger line by line
+func relayWLog(stderr io.Reader) {
+	// the log of [W] has its own levels
+	out := log.Writer()
+	if gate, ok := out.(levelGate); ok {
+		out = gate.out
+	}
+	logger := log.New(out, "[W] ", log.LstdFlags)
+	parser := &wLogParser{emit: func(level logLevel, msg string) {
+		if !logEnabled(level) {
+			return
+		}
+		if level == levelInfo {
+			logger.Print(msg)
+		} else {
+			logger.Printf("%s: %s", level, msg)
+		}
+	}}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		// a pending exception is flushed if no continuation comes soon
+		var flush <-chan time.Time
+		if parser.pending != nil {
+			flush = time.After(wLogFlushDelay)
+		}
+
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				parser.flush()
+				return
+			}
+			parser.feed(line)
+		case <-flush:
+			parser.flush()
+		}
+	}
+}
+
+// a parser of the stderr of [W]: the log of repeater.ps1, PowerShell's
+// multi-line exceptions, CLIXML, and anything else
+type wLogParser struct {
+	emit    func(logLevel, string)
+	pending *wLogBlock
+}
+
+// a block of lines that may be a PowerShell exception:
+//
+//	Exception calling "Connect" with "0" argument(s): "The operation has timed out."
+//	At line:1 char:1
+//	+ $ssh_agent.Connect()
+//	+ ~~~~~~~~~~~~~~~~~~~~
+//	    + CategoryInfo          : NotSpecified: (:) [], MethodInvocationException
+//	    + FullyQualifiedErrorId : TimeoutException
+type wLogBlock struct {
+	msg       string
+	details   []string
+	exception bool
+}
+
+func (p *wLogParser) feed(line string) {
+	line = strings.TrimRight(line, "\r")
+
+	if p.pending != nil && isContinuation(line) {
+		p.pending.add(line)
+		return
+	}
+	p.flush()
+
+	switch {
+	case strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#< CLIXML"):
+	case wLogPattern.MatchString(line):
+		p.emit(levelInfo, wLogPattern.FindStringSubmatch(line)[1])
+	case strings.HasPrefix(line, "<Objs"):
+		p.feedCLIXML(line)
+	default:
+		p.pending = &wLogBlock{msg: line}
+	}
+}
+
+func (p *wLogParser) flush() {
+	if p.pending == nil {
+		return
+	}
+	block := p.pending
+	p.pending = nil
+
+	if !block.exception {
+		// preserve unrecognized output as is
+		p.emit(levelWarn, block.msg)
+		return
+	}
+	msg := block.msg
+	if len(block.details) > 0 {
+		msg += " (" + strings.Join(block.details, "; ") + ")"
+	}
+	p.emit(levelError, msg)
+}
+
+// CLIXML is written when PowerShell thinks that its stderr is read by another
+// PowerShell; error records are collapsed as well as plain text, and progress
+// records are just noise
+func (p *wLogParser) feedCLIXML(line string) {
+	for _, m := range clixmlProgressPattern.FindAllStringSubmatch(line, -1) {
+		p.emit(levelDebug, "progress: "+decodeCLIXML(m[1]))
+	}
+
+	for _, m := range clixmlStringPattern.FindAllStringSubmatch(line, -1) {
+		text := strings.TrimRight(decodeCLIXML(m[2]), "\r\n")
+		switch m[1] {
+		case "Error":
+			for _, l := range strings.Split(text, "\n") {
+				p.feed(l)
+			}
+			if p.pending != nil {
+				p.pending.exception = true
+			}
+		case "Warning":
+			p.flush()
+			p.emit(levelWarn, text)
+		default:
+			p.flush()
+			p.emit(levelDebug, text)
+		}
+	}
+	p.flush()
+}
+
+func decodeCLIXML(s string) string {
+	s = clixmlEscapePattern.ReplaceAllStringFunc(s, func(escape string) string {
+		code, err := strconv.ParseUint(escape[2:6], 16, 16)
+		if err != nil {
+			return escape
+		}
+		return string(rune(code))
+	})
+	return html.UnescapeString(s)
+}
+
+func isContinuation(line string) bool {
+	return strings.HasPrefix(line, " ") ||
+		strings.HasPrefix(line, "\t") ||
+		strings.HasPrefix(line, "At ") ||
+		strings.HasPrefix(line, "+")
+}
+
+func (block *wLogBlock) add(line string) {
+	block.exception = true
+
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "At ") {
+		block.details = append(block.details, line)
+		return
+	}
+	if strings.HasPrefix(line, "+ ") {
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "+ "), ":")
+		key = strings.TrimSpace(key)
+		if ok && (key == "CategoryInfo" || key == "FullyQualifiedErrorId") {
+			block.details = append(block.details, key+": "+strings.TrimSpace(value))
+		}
+		// the source code and the underline are omitted
+		return
+	}
+	if line != "" {
+		// a wrapped message
+		block.msg += " " + line
+	}
+}
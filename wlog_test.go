@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"testing"
+)
+
+func parseWLog(lines ...string) []string {
+	entries := []string{}
+	parser := &wLogParser{emit: func(level logLevel, msg string) {
+		entries = append(entries, fmt.Sprintf("%s: %s", level, msg))
+	}}
+	for _, line := range lines {
+		parser.feed(line)
+	}
+	parser.flush()
+	return entries
+}
+
+func expectEntries(t *testing.T, entries []string, expected ...string) {
+	t.Helper()
+	if len(entries) != len(expected) {
+		t.Fatalf("wrong entries: %q", entries)
+	}
+	for i := range entries {
+		if entries[i] != expected[i] {
+			t.Errorf("wrong entry: %q (expected: %q)", entries[i], expected[i])
+		}
+	}
+}
+
+func TestWLogNormal(t *testing.T) {
+	entries := parseWLog(
+		"[W] 2025/07/29 19:51:28 ready: PSVersion 5.1.22621.5624 (Desktop)\r",
+		"",
+		"[W] 2025/07/29 19:51:28 [W] named pipe: openssh-ssh-agent (ok)",
+		"something unexpected",
+	)
+	expectEntries(t, entries,
+		"info: ready: PSVersion 5.1.22621.5624 (Desktop)",
+		"info: [W] named pipe: openssh-ssh-agent (ok)",
+		"warning: something unexpected",
+	)
+}
+
+func TestWLogException(t *testing.T) {
+	entries := parseWLog(
+		`Exception calling "Connect" with "0" argument(s): "The operation has timed out."`,
+		"At line:1 char:1",
+		"+ $ssh_agent.Connect()",
+		"+ ~~~~~~~~~~~~~~~~~~~~",
+		"    + CategoryInfo          : NotSpecified: (:) [], MethodInvocationException",
+		"    + FullyQualifiedErrorId : TimeoutException",
+		" ",
+		"[W] 2025/07/29 19:51:28 terminated",
+	)
+	expectEntries(t, entries,
+		`error: Exception calling "Connect" with "0" argument(s): "The operation has timed out." `+
+			`(At line:1 char:1; CategoryInfo: NotSpecified: (:) [], MethodInvocationException; FullyQualifiedErrorId: TimeoutException)`,
+		"info: terminated",
+	)
+}
+
+func TestWLogCLIXML(t *testing.T) {
+	entries := parseWLog(
+		"#< CLIXML",
+		`<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04">`+
+			`<Obj S="progress" RefId="0"><TN RefId="0"><T>System.Management.Automation.PSCustomObject</T><T>System.Object</T></TN>`+
+			`<MS><I64 N="SourceId">1</I64><PR N="Record"><AV>Preparing modules for first use.</AV><AI>0</AI><Nil /></PR></MS></Obj>`+
+			`<S S="Error">Get-Command : The term 'ssh-agent.exe' is not recognized_x000D__x000A_</S>`+
+			`<S S="Error">At line:1 char:1_x000D__x000A_</S>`+
+			`<S S="Error">    + FullyQualifiedErrorId : CommandNotFoundException_x000D__x000A_</S>`+
+			`<S S="Warning">disk &amp; memory</S>`+
+			`</Objs>`,
+	)
+	expectEntries(t, entries,
+		"debug: progress: Preparing modules for first use.",
+		"error: Get-Command : The term 'ssh-agent.exe' is not recognized (At line:1 char:1; FullyQualifiedErrorId: CommandNotFoundException)",
+		"warning: disk & memory",
+	)
+}
+
+func TestLevelGate(t *testing.T) {
+	defer atomic.StoreInt32(&minLogLevel, atomic.LoadInt32(&minLogLevel))
+	out := &bytes.Buffer{}
+	logger := log.New(levelGate{out}, "[L] ", 0)
+
+	logger.Print("shown")
+	atomic.StoreInt32(&minLogLevel, int32(levelWarn))
+	logger.Print("hidden")
+	atomic.StoreInt32(&minLogLevel, int32(levelDebug))
+	logger.Print("shown again")
+
+	if out.String() != "[L] shown\n[L] shown again\n" {
+		t.Errorf("wrong log: %q", out.String())
+	}
+}